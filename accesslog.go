@@ -0,0 +1,129 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net"
+import "net/http"
+import "encoding/json"
+import "strconv"
+import "time"
+
+// AccessLogFormat selects the line format used by AccessLog.
+type AccessLogFormat int
+
+const (
+	// The Common Log Format used by most web servers.
+	CommonLogFormat AccessLogFormat = iota
+
+	// Common Log Format plus the referer and user agent.
+	CombinedLogFormat
+
+	// One JSON object per line, see AccessLogEntry.
+	JSONLogFormat
+)
+
+// AccessLogEntry is what JSONLogFormat writes for each request.
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration_ms"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+
+	// The Pattern and Handler of the Route that served the request, so requests can be grouped by route.
+	Route   string `json:"route"`
+	Handler string `json:"handler,omitempty"`
+}
+
+// AccessLog returns Middleware that writes a line to log for every request. Add it to Options.Middleware to log every
+// request the server gets.
+func AccessLog(log Logger, format AccessLogFormat) Middleware {
+	return func(next http.Handler, route *Route) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			w, tw := track(w)
+			next.ServeHTTP(w, r)
+
+			status := tw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			entry := &AccessLogEntry{
+				Time:      start,
+				Remote:    r.RemoteAddr,
+				Method:    r.Method,
+				URI:       r.RequestURI,
+				Proto:     r.Proto,
+				Status:    status,
+				Bytes:     tw.size,
+				Duration:  float64(time.Since(start)) / float64(time.Millisecond),
+				Referer:   r.Referer(),
+				UserAgent: r.UserAgent(),
+				Route:     route.Pattern,
+				Handler:   route.Handler,
+			}
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				entry.Remote = host
+			}
+			if user, _, ok := r.BasicAuth(); ok {
+				entry.User = user
+			}
+			if entry.URI == "" {
+				entry.URI = r.URL.RequestURI()
+			}
+
+			log.Print(entry.format(format))
+		})
+	}
+}
+
+func (e *AccessLogEntry) format(format AccessLogFormat) string {
+	if format == JSONLogFormat {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err.Error()
+		}
+		return string(b)
+	}
+
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	line := dash(e.Remote) + " - " + dash(e.User) + " [" + e.Time.Format("02/Jan/2006:15:04:05 -0700") + "] " +
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto) + " " + strconv.Itoa(e.Status) + " " + strconv.FormatInt(e.Bytes, 10)
+	if format == CombinedLogFormat {
+		line += " " + strconv.Quote(e.Referer) + " " + strconv.Quote(e.UserAgent)
+	}
+	return line
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "strings"
+import "strconv"
+import "time"
+import "crypto/sha256"
+import "encoding/hex"
+
+// computeETag returns a strong entity tag for the given content.
+func computeETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// NotModified sets the ETag and Last-Modified headers (if the values are not empty) and then checks them against the
+// request's If-None-Match and If-Modified-Since headers. If the client's copy is still current a 304 response is
+// written and true is returned, in which case the caller should not write anything else.
+//
+// Only GET and HEAD requests are ever answered with a 304.
+func NotModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	// If-None-Match takes precedence, If-Modified-Since is only considered if it is missing.
+	current := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		current = etag != "" && etagListMatch(inm, etag)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		current = err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	if !current {
+		return false
+	}
+
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagListMatch checks if a comma separated list of entity tags (as found in If-None-Match) contains the given tag.
+// Comparison is weak, as required for If-None-Match.
+func etagListMatch(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveValidated writes content with a strong ETag computed from it, or a 304 if the client already has it.
+func serveValidated(w http.ResponseWriter, r *http.Request, content []byte) (int, error) {
+	if NotModified(w, r, computeETag(content), time.Time{}) {
+		return 0, nil
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	return w.Write(content)
+}
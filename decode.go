@@ -0,0 +1,130 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "mime"
+import "reflect"
+
+// DefaultMaxBodySize is used by JSONHandlers that decode requests but do not set MaxBodySize.
+const DefaultMaxBodySize = 1 << 20
+
+type bodyKey struct{}
+
+// Body returns the decoded request body for a JSONHandler with a Request type. It is always a pointer to a new value
+// of that type (or of the type it points to, if Request is a pointer).
+func Body(r *http.Request) interface{} {
+	return r.Context().Value(bodyKey{})
+}
+
+// decodeBody reads and decodes the request body for h, returning the request with the result attached. Errors are
+// HTTPErrors with the proper status.
+func (h *JSONHandler) decodeBody(r *http.Request) (*http.Request, error) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return r, nil
+	}
+
+	typ, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || typ != "application/json" {
+		return r, NewHTTPError(http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json"))
+	}
+
+	max := h.MaxBodySize
+	if max <= 0 {
+		max = DefaultMaxBodySize
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	_, err = buf.ReadFrom(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return r, NewHTTPError(http.StatusBadRequest, err)
+	}
+	if int64(buf.Len()) > max {
+		return r, NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Errorf("Request body is larger than %v bytes", max))
+	}
+	if buf.Len() == 0 {
+		return r, NewHTTPError(http.StatusBadRequest, errors.New("Request body is empty"))
+	}
+
+	rt := reflect.TypeOf(h.Request)
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	v := reflect.New(rt).Interface()
+	dec := json.NewDecoder(buf)
+	if h.Strict {
+		dec.DisallowUnknownFields()
+	}
+	err = dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("Request body contains more than one value")
+	}
+	if err != nil {
+		return r, NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	if h.Check != nil {
+		err := h.Check(r, v)
+		if err != nil {
+			var herr *HTTPError
+			if !errors.As(err, &herr) {
+				err = NewHTTPError(http.StatusBadRequest, err)
+			}
+			return r, err
+		}
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), bodyKey{}, v)), nil
+}
+
+// ErrorEnvelope is the body JSONError writes.
+type ErrorEnvelope struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// JSONError is an HTTPErrorHandler that writes an ErrorEnvelope. For 4xx errors the message is the error that
+// caused it (see RequestError), for everything else it is just the status text so nothing internal leaks.
+func JSONError(w http.ResponseWriter, r *http.Request, status int) {
+	env := ErrorEnvelope{}
+	env.Error.Status = status
+	env.Error.Message = http.StatusText(status)
+	if err := RequestError(r); err != nil && status >= 400 && status < 500 {
+		var herr *HTTPError
+		if errors.As(err, &herr) && herr.Err != nil {
+			err = herr.Err
+		}
+		env.Error.Message = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(env)
+}
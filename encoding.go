@@ -0,0 +1,185 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "bytes"
+import "strconv"
+import "strings"
+import "compress/gzip"
+
+// Encoding describes a Content-Encoding that static files may be served with.
+type Encoding struct {
+	// File extension used by precompressed siblings, for example "style.css.gz" is the gzip version of "style.css".
+	// Precompressed files are never served directly.
+	Ext string
+
+	// Used to compress files at load time. If nil only precompressed siblings are used.
+	Encode func(content []byte) ([]byte, error)
+}
+
+// Encodings maps Content-Encoding tokens to how they are handled. Add or replace entries to plug in other encoders.
+var Encodings = map[string]Encoding{
+	"gzip": {".gz", gzipEncode},
+	"br":   {".br", nil},
+	"zstd": {".zst", nil},
+}
+
+// EncodingPreference is used to break ties when a client accepts more than one encoding equally.
+var EncodingPreference = []string{"br", "zstd", "gzip"}
+
+// CompressTags lists the tags of files that should be compressed at load time. Files that have precompressed
+// siblings are left alone.
+var CompressTags = []string{"HTML", "StyleSheet", "JavaScript"}
+
+func gzipEncode(content []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(content)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadPrecompressed attaches precompressed siblings to the files they are versions of and hides them.
+func loadPrecompressed(s *Server) {
+	for _, f := range s.Files {
+		for enc, e := range Encodings {
+			if e.Ext == "" || !strings.HasSuffix(f.Name, e.Ext) {
+				continue
+			}
+
+			orig, ok := s.Files[strings.TrimSuffix(f.FullPath(), e.Ext)]
+			if !ok {
+				continue
+			}
+			if orig.Encoded == nil {
+				orig.Encoded = map[string][]byte{}
+			}
+			orig.Encoded[enc] = f.Content
+			f.Tags["Resource"] = true
+			s.log.i.Println("Using ", f.FullPath(), " as ", enc, " version of ", orig.FullPath())
+		}
+	}
+}
+
+// compressFile compresses a file with every available encoder if it has one of the CompressTags. Encodings that
+// already have a version (or that would not make the file any smaller) are skipped.
+func compressFile(f *File) error {
+	eligible := false
+	for _, tag := range CompressTags {
+		if f.Tags[tag] {
+			eligible = true
+			break
+		}
+	}
+	if !eligible {
+		return nil
+	}
+
+	for enc, e := range Encodings {
+		if e.Encode == nil {
+			continue
+		}
+		if _, ok := f.Encoded[enc]; ok {
+			continue
+		}
+
+		content, err := e.Encode(f.Content)
+		if err != nil {
+			return err
+		}
+		if len(content) >= len(f.Content) {
+			continue
+		}
+		if f.Encoded == nil {
+			f.Encoded = map[string][]byte{}
+		}
+		f.Encoded[enc] = content
+	}
+	return nil
+}
+
+// negotiateEncoding picks the best encoding from the available ones based on an Accept-Encoding header. An empty
+// result means identity.
+func negotiateEncoding(accept string, available map[string][]byte) string {
+	if accept == "" || len(available) == 0 {
+		return ""
+	}
+
+	q := map[string]float64{}
+	for _, v := range strings.Split(accept, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		name, weight := v, 1.0
+		if i := strings.Index(v, ";"); i >= 0 {
+			name = strings.TrimSpace(v[:i])
+			param := strings.TrimSpace(v[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				w, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					weight = w
+				}
+			}
+		}
+		q[strings.ToLower(name)] = weight
+	}
+
+	best, bestq := "", 0.0
+	for _, enc := range EncodingPreference {
+		if _, ok := available[enc]; !ok {
+			continue
+		}
+		w, ok := q[enc]
+		if !ok {
+			w = q["*"]
+		}
+		if w > bestq {
+			best, bestq = enc, w
+		}
+	}
+	for enc := range available {
+		w, ok := q[enc]
+		if ok && w > bestq {
+			best, bestq = enc, w
+		}
+	}
+	return best
+}
+
+// encodedETag derives the entity tag for an encoded version of a file. Each version needs its own strong tag.
+func encodedETag(etag, enc string) string {
+	if enc == "" || etag == "" {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + enc + `"`
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "context"
+import "errors"
+import "bufio"
+import "io"
+import "net"
+
+// HTTPError is an error with an HTTP status code attached. Return one from an ErrorHandlerFunc (or from a Data
+// function) to have the error handler called with that status.
+type HTTPError struct {
+	Status int
+	Err    error // May be nil.
+}
+
+// NewHTTPError wraps err with a status code.
+func NewHTTPError(status int, err error) *HTTPError {
+	return &HTTPError{Status: status, Err: err}
+}
+
+func (err *HTTPError) Error() string {
+	if err.Err == nil {
+		return http.StatusText(err.Status)
+	}
+	return http.StatusText(err.Status) + ": " + err.Err.Error()
+}
+
+func (err *HTTPError) Unwrap() error {
+	return err.Err
+}
+
+// StatusCode returns the status code for an error. Errors that are not (and do not wrap) an HTTPError are 500s.
+func StatusCode(err error) int {
+	var herr *HTTPError
+	if errors.As(err, &herr) {
+		return herr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+type errorKey struct{}
+
+// Handlers may override the server's error handler by adding theirs to the request context with this key.
+type errhandlerKey struct{}
+
+// RequestError returns the error that caused the error handler to be called, or nil if there is none (404s, for
+// example). Only useful inside an HTTPErrorHandler.
+func RequestError(r *http.Request) error {
+	err, _ := r.Context().Value(errorKey{}).(error)
+	return err
+}
+
+// ErrorHandlerFunc is an http.HandlerFunc that may return an error. When used as the Logic of a SimpleHandler errors
+// are passed to the error handler with the status from StatusCode. Used anywhere else errors are sent with
+// http.Error.
+type ErrorHandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+func (f ErrorHandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := f(w, r)
+	if err != nil {
+		status := StatusCode(err)
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// fail passes a request to the error handler. Errors are logged, and made available to the error handler with
+// RequestError.
+//
+// If the response has already been started there is nothing useful the error handler can do, so it is not called.
+func (s *Server) fail(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if err != nil {
+		s.log.e.Println("Error handling ", r.Method, " ", r.URL.Path, " (", status, "): ", err)
+		r = r.WithContext(context.WithValue(r.Context(), errorKey{}, err))
+	}
+
+	if headersWritten(w) {
+		s.log.e.Println("Response for ", r.URL.Path, " already started, cannot send ", status, ".")
+		return
+	}
+	if eh, ok := r.Context().Value(errhandlerKey{}).(HTTPErrorHandler); ok {
+		eh(w, r, status)
+		return
+	}
+	s.errhandler(w, r, status)
+}
+
+// trackingWriter remembers if the response has been started, and what was sent.
+type trackingWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *trackingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *trackingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *trackingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (w *trackingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *trackingWriter) tracker() *trackingWriter {
+	return w
+}
+
+func (w *trackingWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols // The connection is someone else's problem now.
+	}
+	return conn, rw, err
+}
+
+func (w *trackingWriter) readFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	w.size += n
+	return n, err
+}
+
+// These pass on the optional interfaces of the writer they wrap, so wrapping does not hide them. See track.
+type trackingHijacker struct{ *trackingWriter }
+type trackingReaderFrom struct{ *trackingWriter }
+type trackingHijackerReaderFrom struct{ *trackingWriter }
+
+func (w trackingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) { return w.hijack() }
+
+func (w trackingReaderFrom) ReadFrom(r io.Reader) (int64, error) { return w.readFrom(r) }
+
+func (w trackingHijackerReaderFrom) Hijack() (net.Conn, *bufio.ReadWriter, error) { return w.hijack() }
+
+func (w trackingHijackerReaderFrom) ReadFrom(r io.Reader) (int64, error) { return w.readFrom(r) }
+
+// track wraps w in a trackingWriter. The returned writer implements http.Hijacker and io.ReaderFrom if w does.
+func track(w http.ResponseWriter) (http.ResponseWriter, *trackingWriter) {
+	tw := &trackingWriter{ResponseWriter: w}
+	_, hijacker := w.(http.Hijacker)
+	_, readerFrom := w.(io.ReaderFrom)
+	switch {
+	case hijacker && readerFrom:
+		return trackingHijackerReaderFrom{tw}, tw
+	case hijacker:
+		return trackingHijacker{tw}, tw
+	case readerFrom:
+		return trackingReaderFrom{tw}, tw
+	}
+	return tw, tw
+}
+
+// headersWritten checks if any trackingWriter in w's chain of wrappers has seen the response start.
+func headersWritten(w http.ResponseWriter) bool {
+	for {
+		switch tw := w.(type) {
+		case interface{ tracker() *trackingWriter }:
+			return tw.tracker().status != 0
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = tw.Unwrap()
+		default:
+			return false
+		}
+	}
+}
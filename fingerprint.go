@@ -0,0 +1,70 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "strings"
+import filepath "path"
+
+// fingerprinted returns true if f has one of the FingerprintTags.
+func (s *Server) fingerprinted(f *File) bool {
+	for _, tag := range s.FingerprintTags {
+		if f.Tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprintPath inserts part of f's content hash before the extension of p, for example "/style.css" becomes
+// "/style.3f9a1c2b.css".
+func fingerprintPath(p string, f *File) string {
+	hash := strings.Trim(f.ETag, `"`)
+	if len(hash) > 8 {
+		hash = hash[:8]
+	}
+
+	dir, name := filepath.Split(p)
+	ext := getExt(name)
+	return dir + strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// mountFingerprinted serves f at its fingerprinted URL, and at p (or a redirect to the fingerprinted URL if
+// RedirectUnfingerprinted is set). The fingerprinted URL is always sent with the Immutable caching headers.
+func (s *Server) mountFingerprinted(p string, f *File, policy *Policy) error {
+	fp := fingerprintPath(p, f)
+	s.urls[f.FullPath()] = fp
+	s.Manifest[p] = fp
+
+	immutable := *policy
+	immutable.merge(Immutable)
+	err := s.mountFile(fp, f, &immutable)
+	if err != nil {
+		return err
+	}
+
+	if s.RedirectUnfingerprinted {
+		return s.mountRedirect(p, fp, f, http.StatusFound)
+	}
+	return s.mountFile(p, f, policy)
+}
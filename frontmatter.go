@@ -0,0 +1,294 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "regexp"
+import "strconv"
+import "strings"
+
+// parseFrontMatter splits front matter from the rest of the content. If there is no front matter meta is nil and body
+// is content. Three formats are understood:
+//
+//	YAML between two "---" lines.
+//	TOML between two "+++" lines.
+//	A JSON object starting on the first line (with a "{" on its own).
+//
+// Only a subset of YAML and TOML is understood, see parseYAML and parseTOML.
+func parseFrontMatter(content []byte) (meta map[string]interface{}, body []byte, err error) {
+	switch {
+	case hasLine(content, "---"):
+		lines, body, err := splitBlock(content, "---", "...")
+		if err != nil {
+			return nil, nil, err
+		}
+		meta, err = parseYAML(lines, 2) // After the opening delimiter.
+		return meta, body, err
+	case hasLine(content, "+++"):
+		lines, body, err := splitBlock(content, "+++")
+		if err != nil {
+			return nil, nil, err
+		}
+		meta, err = parseTOML(lines, 2)
+		return meta, body, err
+	case hasLine(content, "{"):
+		dec := json.NewDecoder(bytes.NewReader(content))
+		err := dec.Decode(&meta)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = content[dec.InputOffset():]
+		if i := bytes.IndexByte(body, '\n'); i >= 0 && len(bytes.TrimSpace(body[:i])) == 0 {
+			body = body[i+1:]
+		}
+		return meta, body, nil
+	}
+	return nil, content, nil
+}
+
+// parseMeta parses a sidecar metadata file. JSON objects, TOML and YAML are understood, as for front matter but
+// without the delimiters.
+func parseMeta(content []byte) (map[string]interface{}, error) {
+	trimmed := bytes.TrimSpace(content)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		meta := map[string]interface{}{}
+		err := json.Unmarshal(trimmed, &meta)
+		return meta, err
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if tomlKey.MatchString(line) {
+			return parseTOML(lines, 1)
+		}
+		break
+	}
+	return parseYAML(lines, 1)
+}
+
+// hasLine returns true if content starts with a line that is exactly delim.
+func hasLine(content []byte, delim string) bool {
+	return bytes.HasPrefix(content, []byte(delim+"\n")) || bytes.HasPrefix(content, []byte(delim+"\r\n"))
+}
+
+// splitBlock splits the lines between a starting delimiter line and one of the ends (or the starting delimiter if
+// there are none) from the rest of the content.
+func splitBlock(content []byte, delim string, ends ...string) ([]string, []byte, error) {
+	ends = append(ends, delim)
+	rest := content[bytes.IndexByte(content, '\n')+1:]
+
+	lines := []string{}
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		var line []byte
+		if i < 0 {
+			line, rest = rest, nil
+		} else {
+			line, rest = rest[:i], rest[i+1:]
+		}
+		l := strings.TrimRight(string(line), "\r")
+		for _, end := range ends {
+			if l == end {
+				return lines, rest, nil
+			}
+		}
+		if rest == nil {
+			return nil, nil, errors.New("Front matter is not closed.")
+		}
+		lines = append(lines, l)
+	}
+}
+
+// yamlLine is a line of YAML that is not blank or a comment.
+type yamlLine struct {
+	n      int // Line number in the file.
+	indent int
+	text   string // Without the indentation.
+}
+
+// parseYAML parses a subset of YAML: "key: value" pairs, lists written as "[a, b]" or as "- item" lines under the key,
+// maps written as more indented "key: value" lines under the key, and comments. Values are strings, bools, int64s, or
+// float64s, lists are []interface{}, and maps are map[string]interface{}. first is the line number of lines[0] in the
+// file, for errors.
+func parseYAML(lines []string, first int) (map[string]interface{}, error) {
+	ls := []yamlLine{}
+	for n, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		ls = append(ls, yamlLine{n + first, len(line) - len(strings.TrimLeft(line, " \t")), trimmed})
+	}
+
+	meta, rest, err := parseYAMLMap(ls)
+	if err == nil && len(rest) != 0 {
+		err = errors.New("Line " + strconv.Itoa(rest[0].n) + ": unexpected indentation.")
+	}
+	return meta, err
+}
+
+// parseYAMLMap parses the "key: value" lines at the indentation of the first line, and everything under them. Returns
+// the lines after the map.
+func parseYAMLMap(ls []yamlLine) (map[string]interface{}, []yamlLine, error) {
+	meta := map[string]interface{}{}
+	if len(ls) == 0 {
+		return meta, nil, nil
+	}
+
+	indent := ls[0].indent
+	key := ""
+	for len(ls) != 0 && ls[0].indent >= indent {
+		l := ls[0]
+		switch {
+		case strings.HasPrefix(l.text, "- ") || l.text == "-":
+			list, ok := meta[key].([]interface{})
+			if key == "" || (!ok && meta[key] != nil) {
+				return nil, nil, errors.New("Line " + strconv.Itoa(l.n) + ": list item without a key.")
+			}
+			meta[key] = append(list, parseScalar(strings.TrimSpace(strings.TrimPrefix(l.text, "-"))))
+			ls = ls[1:]
+			continue
+		case l.indent > indent:
+			if key == "" || meta[key] != nil {
+				return nil, nil, errors.New("Line " + strconv.Itoa(l.n) + ": unexpected indentation.")
+			}
+			var err error
+			meta[key], ls, err = parseYAMLMap(ls)
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		i := strings.Index(l.text, ":")
+		if i <= 0 {
+			return nil, nil, errors.New("Line " + strconv.Itoa(l.n) + ": expected \"key: value\".")
+		}
+		key = strings.TrimSpace(l.text[:i])
+		value := strings.TrimSpace(l.text[i+1:])
+		switch {
+		case value == "":
+			meta[key] = nil // Maybe a list or map follows.
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			list := []interface{}{}
+			for _, item := range splitList(value[1 : len(value)-1]) {
+				list = append(list, parseScalar(item))
+			}
+			meta[key] = list
+		default:
+			meta[key] = parseScalar(value)
+		}
+		ls = ls[1:]
+	}
+	return meta, ls, nil
+}
+
+// splitList splits a comma separated list, ignoring commas in quoted items.
+func splitList(s string) []string {
+	items := []string{}
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" || len(items) != 0 {
+		items = append(items, last)
+	}
+	return items
+}
+
+// parseScalar converts a single value to a bool, number or string.
+func parseScalar(s string) interface{} {
+	if len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"') {
+		if v, err := strconv.Unquote(s); err == nil {
+			return v
+		}
+	}
+	if len(s) >= 2 && (s[0] == '\'' && s[len(s)-1] == '\'') {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v
+	}
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v
+	}
+	return s
+}
+
+var tomlKey = regexp.MustCompile(`^[A-Za-z0-9_-]+[ \t]*=`)
+
+// parseTOML parses a subset of TOML: "key = value" pairs and comments. Values are as for parseYAML. Tables are not
+// supported. first is as for parseYAML.
+func parseTOML(lines []string, first int) (map[string]interface{}, error) {
+	meta := map[string]interface{}{}
+	for n, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if !tomlKey.MatchString(trimmed) {
+			return nil, errors.New("Line " + strconv.Itoa(n+first) + ": expected \"key = value\".")
+		}
+
+		i := strings.Index(trimmed, "=")
+		key := strings.TrimSpace(trimmed[:i])
+		value := strings.TrimSpace(trimmed[i+1:])
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			list := []interface{}{}
+			for _, item := range splitList(value[1 : len(value)-1]) {
+				list = append(list, parseScalar(item))
+			}
+			meta[key] = list
+			continue
+		}
+		meta[key] = parseScalar(value)
+	}
+	return meta, nil
+}
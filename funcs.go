@@ -0,0 +1,153 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "html/template"
+import "encoding/json"
+import "errors"
+import "strconv"
+import "strings"
+import "time"
+import filepath "path"
+
+// templateFuncs returns the functions available to every template. Options.Funcs are added last, so they may
+// replace any of these.
+//
+//	asset NAME           The URL a static file is served at (see Server.Lookup for the accepted names). This is
+//	                     the fingerprinted URL for fingerprinted files, see Options.FingerprintTags.
+//	embed NAME           The contents of a loaded file. HTML, StyleSheet and JavaScript files are not escaped.
+//	meta NAME            The metadata of a loaded file (see File.Meta), an empty map if it has none.
+//	json VALUE           VALUE encoded as JSON, safe to use inside a script.
+//	date LAYOUT TIME     TIME formatted with LAYOUT (see time.Time.Format).
+//	number PLACES VALUE  VALUE with PLACES decimal places and commas between the thousands.
+//	pathJoin ELEM...     The elements joined into a clean slash separated path.
+func templateFuncs(s *Server) template.FuncMap {
+	funcs := template.FuncMap{
+		"asset": func(name string) (string, error) {
+			f, err := s.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			url, ok := s.urls[f.FullPath()]
+			if !ok {
+				return "", errors.New("File " + name + " is not served statically.")
+			}
+			return url, nil
+		},
+		"embed": func(name string) (interface{}, error) {
+			f, err := s.Lookup(name)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case f.Tags["HTML"]:
+				return template.HTML(f.Content), nil
+			case f.Tags["StyleSheet"]:
+				return template.CSS(f.Content), nil
+			case f.Tags["JavaScript"]:
+				return template.JS(f.Content), nil
+			}
+			return string(f.Content), nil
+		},
+		"meta": func(name string) (map[string]interface{}, error) {
+			f, err := s.Lookup(name)
+			if err != nil {
+				return nil, err
+			}
+			if f.Meta == nil {
+				return map[string]interface{}{}, nil
+			}
+			return f.Meta, nil
+		},
+		"json": func(v interface{}) (template.JS, error) {
+			b, err := json.Marshal(v) // Escapes <, >, and &, so this can't end a script early.
+			if err != nil {
+				return "", err
+			}
+			return template.JS(b), nil
+		},
+		"date": func(layout string, t time.Time) string {
+			return t.Format(layout)
+		},
+		"number":   formatNumber,
+		"pathJoin": filepath.Join,
+	}
+
+	for name, f := range s.Funcs {
+		funcs[name] = f
+	}
+	return funcs
+}
+
+// formatNumber formats any integer or float with the given number of decimal places and commas between the
+// thousands.
+func formatNumber(places int, v interface{}) (string, error) {
+	var f float64
+	switch n := v.(type) {
+	case int:
+		f = float64(n)
+	case int8:
+		f = float64(n)
+	case int16:
+		f = float64(n)
+	case int32:
+		f = float64(n)
+	case int64:
+		f = float64(n)
+	case uint:
+		f = float64(n)
+	case uint8:
+		f = float64(n)
+	case uint16:
+		f = float64(n)
+	case uint32:
+		f = float64(n)
+	case uint64:
+		f = float64(n)
+	case float32:
+		f = float64(n)
+	case float64:
+		f = n
+	default:
+		return "", errors.New("number: value is not a number")
+	}
+
+	str := strconv.FormatFloat(f, 'f', places, 64)
+	sign := ""
+	if strings.HasPrefix(str, "-") {
+		sign, str = "-", str[1:]
+	}
+	whole, frac := str, ""
+	if i := strings.Index(str, "."); i >= 0 {
+		whole, frac = str[:i], str[i:]
+	}
+
+	buf := []byte{}
+	for i := range whole {
+		if i != 0 && (len(whole)-i)%3 == 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, whole[i])
+	}
+	return sign + string(buf) + frac, nil
+}
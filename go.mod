@@ -1,5 +1,5 @@
 module github.com/milochristiansen/httphelper
 
-go 1.15
+go 1.16
 
 require github.com/milochristiansen/axis2 v0.0.0-20170331171230-20ad74518c74
@@ -24,81 +24,119 @@ package httphelper
 
 import "net/http"
 import "mime"
-import "errors"
-import "html/template"
+import "fmt"
+import "context"
+import "io"
 import filepath "path"
 import "encoding/json"
 
-import "github.com/milochristiansen/axis2"
-
 // SimpleHandler is the handler type for binding a function or whatever to a path.
 type SimpleHandler struct {
 	// AXIS paths for resources assigned to this Handler. You may use other resources as well,
 	// but anything listed here will be marked off the list of files to serve statically.
+	// See Server.Lookup for the accepted path forms.
 	Resources []string
 
-	// The handler logic. See also http.HandlerFunc.
+	// The handler logic. See also http.HandlerFunc and ErrorHandlerFunc.
 	Logic http.Handler
 
-	Path  string // The path this handler is responsible for.
-	Loose bool   // If true do no automatically insert a check for path supersets.
+	Path  string // The path (or pattern, see Params) this handler is responsible for.
+	Loose bool   // If true do no automatically insert a check for path supersets. Ignored for patterns.
+
+	// The HTTP methods this handler accepts. If nil every method but OPTIONS is passed to Logic, OPTIONS is answered
+	// with an Allow header listing the common methods.
+	Methods []string
+
+	// Middleware for this handler only. Applied inside the server's middleware.
+	Middleware []Middleware
 }
 
-func (h *SimpleHandler) initalize(fs *axis2.FileSystem, s *Server) error {
-	err := handlerBoilerplate(h.Path, h.Resources, s)
+func (h *SimpleHandler) initalize(fs DataSource, s *Server) error {
+	err := handlerBoilerplate(h.Path, h.Methods, h.Resources, s)
 	if err != nil {
 		return err
 	}
 
-	if h.Loose {
-		s.Handlers.Handle(h.Path, h.Logic)
-	} else {
-		s.Handlers.HandleFunc(h.Path, func(w http.ResponseWriter, r *http.Request) {
-			if r.URL.Path != h.Path {
-				s.log.i.Println("Rejecting request for ", r.URL.Path, " in handler for ", h.Path)
-				s.errhandler(w, r, http.StatusNotFound)
-				return
+	logic := h.Logic.ServeHTTP
+	if eh, ok := h.Logic.(ErrorHandlerFunc); ok {
+		logic = func(w http.ResponseWriter, r *http.Request) {
+			err := eh(w, r)
+			if err != nil {
+				s.fail(w, r, StatusCode(err), err)
 			}
-
-			h.Logic.ServeHTTP(w, r)
-		})
+		}
 	}
+
+	route := &Route{Pattern: h.Path, Handler: "SimpleHandler"}
+	s.handle(h.Path, h.Loose && !isPattern(h.Path), h.Methods, s.wrap(route, h.Middleware, logic))
 	return nil
 }
 
-func handlerBoilerplate(path string, resources []string, s *Server) error {
+func handlerBoilerplate(path string, methods []string, resources []string, s *Server) error {
 	s.log.i.Println("Building handler for ", path)
 
-	if s.hasHandler[path] {
-		s.log.e.Println("A handler for ", path, " already exists.")
-		return errors.New("A handler for " + path + " already exists.")
+	err := s.reservePath(path, methods)
+	if err != nil {
+		return err
 	}
-	s.hasHandler[path] = true
 
 	for _, p := range resources {
-		f, ok := s.Files[p]
-		if !ok {
+		f, err := s.Lookup(p)
+		if s.ambiguous(err) {
+			continue
+		}
+		if err != nil {
 			s.log.e.Println("Resource ", p, " does not exist.")
-			return errors.New("Resource " + p + " does not exist.")
+			return err
 		}
 		f.Tags["Resource"] = true
 	}
 	return nil
 }
 
-func staticPageHandler(f *File, s *Server, mountpoint string) func(w http.ResponseWriter, r *http.Request) {
+// staticMethods are the methods static files may be requested with (HEAD is implied).
+var staticMethods = []string{http.MethodGet}
+
+func encodeJSON(w io.Writer, data interface{}, pretty, rawHTML bool) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(!rawHTML)
+	if pretty {
+		enc.SetIndent("", "\t")
+	}
+	return enc.Encode(data)
+}
+
+func staticPageHandler(f *File, s *Server, policy *Policy) func(w http.ResponseWriter, r *http.Request) {
+	typ := policy.ContentType
+	if typ == "" {
+		typ = mime.TypeByExtension(getExt(f.Name))
+	}
+	if typ == "" && f.Tags["HTML"] {
+		typ = "text/html; charset=utf-8" // Pages made from Markdown have no extension.
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != mountpoint {
-			s.log.i.Println("Rejecting request for ", r.URL.Path, " in handler for ", mountpoint)
-			s.errhandler(w, r, http.StatusNotFound)
+		// Set before the validators are checked, 304s should carry the caching headers too.
+		policy.apply(w)
+
+		content, etag := f.Content, f.ETag
+		if len(f.Encoded) != 0 {
+			w.Header().Add("Vary", "Accept-Encoding")
+			enc := negotiateEncoding(r.Header.Get("Accept-Encoding"), f.Encoded)
+			if enc != "" {
+				w.Header().Set("Content-Encoding", enc)
+				content, etag = f.Encoded[enc], encodedETag(f.ETag, enc)
+			}
+		}
+
+		if NotModified(w, r, etag, f.Modified) {
 			return
 		}
 
-		typ := mime.TypeByExtension(getExt(f.Name))
 		if typ != "" {
 			w.Header().Set("Content-Type", typ)
 		}
-		n, err := w.Write(f.Content) // This may error out, but we can't do anything about it (except maybe log it) at this point.
+		n, err := serveRanges(w, r, s, content, etag, f.Modified) // This may error out, but we can't do anything about it (except maybe log it) at this point.
 		if err != nil {
 			s.log.e.Println("Error in static page handler: ", err, " bytes written: ", n)
 		}
@@ -109,54 +147,92 @@ func staticPageHandler(f *File, s *Server, mountpoint string) func(w http.Respon
 type TemplateHandler struct {
 	// AXIS paths for resources assigned to this Handler. You may use other resources as well,
 	// but anything listed here will be marked off the list of files to serve statically.
+	// See Server.Lookup for the accepted path forms.
 	Resources []string
 	Template  string // The AXIS path to the template file (also list in Resources)
 
-	// Return the data object the template needs to operate.
+	// The name of a layout to render instead of the template, which should define the layout's blocks.
+	// Layouts and partials are shared by every TemplateHandler, see TagsFirst.
+	Layout string
+
+	// Return the data object the template needs to operate. If this returns nil it is assumed the response was already
+	// written, if it returns an error that is passed to the error handler (see HTTPError). Return a Response to set
+	// the status code or headers.
 	Data func(w http.ResponseWriter, r *http.Request) interface{}
 
-	Path string // The path this handler is responsible for.
+	Path string // The path (or pattern, see Params) this handler is responsible for.
 
-	page *template.Template
-	name string
+	// If true the rendered page is hashed and served with an ETag, so clients may make conditional requests.
+	Validate bool
+
+	// Pages are normally rendered into a buffer first, so that if the template fails the error handler can send a
+	// proper 500 instead of half a page. If true the page is written as it renders instead, which saves memory for
+	// very large pages. Ignored if Validate is set.
+	Stream bool
+
+	// The HTTP methods this handler accepts. If nil only GET (and so HEAD) is accepted.
+	Methods []string
+
+	// Middleware for this handler only. Applied inside the server's middleware.
+	Middleware []Middleware
 }
 
-func (h *TemplateHandler) initalize(fs *axis2.FileSystem, s *Server) error {
-	err := handlerBoilerplate(h.Path, h.Resources, s)
+func (h *TemplateHandler) initalize(fs DataSource, s *Server) error {
+	methods := h.Methods
+	if methods == nil {
+		methods = []string{http.MethodGet}
+	}
+	err := handlerBoilerplate(h.Path, methods, h.Resources, s)
 	if err != nil {
 		return err
 	}
 
-	h.name = stripExt(filepath.Base(h.Template))
-
-	f, ok := s.Files[h.Template]
-	if !ok {
-		s.log.e.Println("Error in TemplateHandler ", h.name, ": Resource ", h.Template, " does not exist.")
-		return errors.New("Resource " + h.Template + " does not exist.")
+	// Keep these local, a reload may be initializing the same handler while the old version is still serving.
+	name := stripExt(filepath.Base(h.Template))
+	page, typ, err := s.loadPage(h.Template, h.Layout)
+	if s.ambiguous(err) {
+		return nil // Reported by Initialize once every handler is done.
 	}
-
-	h.page, err = template.New(h.name).Parse(string(f.Content))
 	if err != nil {
-		s.log.e.Println("Error in TemplateHandler ", h.name, ": ", err)
+		s.log.e.Println("Error in TemplateHandler ", name, ": ", err)
 		return err
 	}
 
-	s.Handlers.HandleFunc(h.Path, func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != h.Path {
-			s.log.i.Println("Rejecting request for ", r.URL.Path, " in handler for ", h.Path)
-			s.errhandler(w, r, http.StatusNotFound)
+	route := &Route{Pattern: h.Path, Handler: "TemplateHandler"}
+	s.handle(h.Path, false, methods, s.wrap(route, h.Middleware, func(w http.ResponseWriter, r *http.Request) {
+		d := h.Data(w, r)
+		if d == nil {
+			return
+		}
+		d, status, ok := s.unpackData(w, r, d)
+		if !ok {
 			return
 		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", typ)
+		}
 
-		d := h.Data(w, r)
-		if d == nil {
+		if h.Stream && !h.Validate {
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+			}
+			err := page.Execute(w, d)
+			if err != nil {
+				s.fail(w, r, http.StatusInternalServerError, fmt.Errorf("Error in TemplateHandler %v: %w", name, err))
+			}
 			return
 		}
-		err := h.page.Execute(w, d)
+
+		buf := getBuffer()
+		defer putBuffer(buf)
+		err := page.Execute(buf, d)
 		if err != nil {
-			s.log.e.Println("Error in TemplateHandler ", h.name, ": ", err)
+			w.Header().Del("Content-Type")
+			s.fail(w, r, http.StatusInternalServerError, fmt.Errorf("Error in TemplateHandler %v: %w", name, err))
+			return
 		}
-	})
+		writeBuffered(w, r, status, h.Validate, buf.Bytes())
+	}))
 
 	return nil
 }
@@ -165,32 +241,88 @@ func (h *TemplateHandler) initalize(fs *axis2.FileSystem, s *Server) error {
 type JSONHandler struct {
 	// AXIS paths for resources assigned to this Handler. You may use other resources as well,
 	// but anything listed here will be marked off the list of files to serve statically.
+	// See Server.Lookup for the accepted path forms.
 	Resources []string
 
-	// Take a request, and return an object to marshal as JSON.
+	// Take a request, and return an object to marshal as JSON. If this returns an error it is passed to the error
+	// handler instead (see HTTPError). Return a Response to set the status code or headers.
 	Data func(w http.ResponseWriter, r *http.Request) interface{}
 
-	Path string // The path this handler is responsible for.
+	Path string // The path (or pattern, see Params) this handler is responsible for.
+
+	// If true the encoded JSON is hashed and served with an ETag, so clients may make conditional requests.
+	Validate bool
+
+	// The HTTP methods this handler accepts. If nil only GET (and so HEAD) is accepted, or GET and POST if Request is
+	// set. List the methods to accept anything else.
+	Methods []string
+
+	// Middleware for this handler only. Applied inside the server's middleware.
+	Middleware []Middleware
+
+	// If set, request bodies (for anything but GET and HEAD) are decoded into a new value of the same type as this
+	// before Data is called. Use Body to get the result. The Content-Type must be application/json.
+	Request interface{}
+
+	MaxBodySize int64 // Larger bodies are rejected with a 413. If not set DefaultMaxBodySize is used.
+	Strict      bool  // If true bodies with fields that do not exist in the Request type are rejected.
+
+	// Called after the body is decoded. Errors are sent to the error handler, as 400s unless they are HTTPErrors.
+	Check func(r *http.Request, v interface{}) error
+
+	// Used instead of the server's error handler for this handler's errors if set. JSONError is a good choice.
+	ErrorHandler HTTPErrorHandler
+
+	Pretty      bool   // If true the output is indented.
+	PrettyQuery string // If set, the output is indented for requests that have a query parameter with this name.
+	RawHTML     bool   // If true <, >, and & in strings are not escaped.
 }
 
-func (h *JSONHandler) initalize(fs *axis2.FileSystem, s *Server) error {
-	err := handlerBoilerplate(h.Path, h.Resources, s)
+func (h *JSONHandler) initalize(fs DataSource, s *Server) error {
+	methods := h.Methods
+	if methods == nil {
+		methods = []string{http.MethodGet}
+		if h.Request != nil {
+			methods = append(methods, http.MethodPost)
+		}
+	}
+	err := handlerBoilerplate(h.Path, methods, h.Resources, s)
 	if err != nil {
 		return err
 	}
 
-	s.Handlers.HandleFunc(h.Path, func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != h.Path {
-			s.log.i.Println("Rejecting request for ", r.URL.Path, " in handler for ", h.Path)
-			s.errhandler(w, r, http.StatusNotFound)
+	route := &Route{Pattern: h.Path, Handler: "JSONHandler"}
+	s.handle(h.Path, false, methods, s.wrap(route, h.Middleware, func(w http.ResponseWriter, r *http.Request) {
+		if h.ErrorHandler != nil {
+			r = r.WithContext(context.WithValue(r.Context(), errhandlerKey{}, h.ErrorHandler))
+		}
+		if h.Request != nil {
+			var err error
+			r, err = h.decodeBody(r)
+			if err != nil {
+				s.fail(w, r, StatusCode(err), err)
+				return
+			}
+		}
+
+		data, status, ok := s.unpackData(w, r, h.Data(w, r))
+		if !ok {
 			return
 		}
 
-		data := h.Data(w, r)
-		err = json.NewEncoder(w).Encode(data)
+		// Everything is encoded into a buffer local to this request, so nothing is shared between requests.
+		buf := getBuffer()
+		defer putBuffer(buf)
+		pretty := h.Pretty || (h.PrettyQuery != "" && r.URL.Query().Get(h.PrettyQuery) != "")
+		err := encodeJSON(buf, data, pretty, h.RawHTML)
 		if err != nil {
-			s.log.e.Println("Could not marshal data for JSON handler\n  ", err)
+			s.fail(w, r, http.StatusInternalServerError, fmt.Errorf("Could not marshal data for JSON handler: %w", err))
+			return
+		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		}
-	})
+		writeBuffered(w, r, status, h.Validate, buf.Bytes())
+	}))
 	return nil
 }
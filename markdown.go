@@ -0,0 +1,594 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "bytes"
+import "errors"
+import "fmt"
+import "html/template"
+import "sort"
+import "time"
+import "html"
+import "regexp"
+import "strconv"
+import "strings"
+
+// MarkdownPage is the data a layout is rendered with for a Markdown file, see Markdown.
+type MarkdownPage struct {
+	Title string    // The "title" metadata key.
+	Date  time.Time // The "date" metadata key, as YYYY-MM-DD or RFC 3339.
+	Tags  []string  // The "tags" metadata key.
+
+	Content template.HTML          // The rendered Markdown.
+	Meta    map[string]interface{} // All the metadata.
+	File    *File                  // The Markdown file.
+}
+
+// Markdown renders files tagged Markdown (a ".md" extension) to HTML. The result is a new file tagged HTML with the
+// same name minus the extension, so "docs/intro.md" is served at "/docs/intro". The Markdown file becomes a resource.
+//
+// The file's metadata (see File.Meta) is used for the page too. If a layout is named by the "layout" key or by
+// Options.MarkdownLayout (set "layout" to "" to opt out) the page is rendered with it, using a MarkdownPage as the
+// data. This happens after every other transformer has run and every handler is built, so the layout may use asset
+// and embed freely.
+var Markdown = Transformer{
+	Name: "Markdown",
+	Tags: []string{"Markdown"},
+	Transform: func(s *Server, f *File) error {
+		name := stripExt(f.Name)
+		full := (&File{Name: name, Source: f.Source}).FullPath()
+		if _, ok := s.Files[full]; ok {
+			return errors.New("Markdown file " + f.FullPath() + " would replace " + full)
+		}
+
+		page := &MarkdownPage{Meta: f.Meta, File: f}
+		page.Title = metaString(f, "title")
+		if list, ok := f.Meta["tags"].([]interface{}); ok {
+			for _, tag := range list {
+				page.Tags = append(page.Tags, fmt.Sprint(tag))
+			}
+		}
+		if date := metaString(f, "date"); date != "" {
+			var err error
+			page.Date, err = parseDate(date)
+			if err != nil {
+				return err
+			}
+		}
+
+		f.Tags["Resource"] = true
+		out := &File{
+			Name:     name,
+			Source:   f.Source,
+			Content:  renderMarkdown(f.Content),
+			Tags:     map[string]bool{"HTML": true},
+			Modified: f.Modified,
+			Meta:     f.Meta,
+		}
+		s.addFile(out)
+		applyMetaTags(out)
+		s.pages[out.FullPath()] = page
+		return nil
+	},
+}
+
+// parseDate parses the date formats allowed in front matter.
+func parseDate(date string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		t, err := time.Parse(layout, date)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("Invalid date: " + date)
+}
+
+// renderPages renders every Markdown page that has a layout.
+func renderPages(s *Server) error {
+	paths := []string{}
+	for p := range s.pages {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var set *template.Template
+	for _, p := range paths {
+		page := s.pages[p]
+		layout, ok := page.Meta["layout"].(string)
+		if !ok {
+			layout = s.MarkdownLayout
+		}
+		if layout == "" {
+			continue
+		}
+
+		if set == nil {
+			var err error
+			set, err = s.templates.Clone()
+			if err != nil {
+				return err
+			}
+		}
+		t := set.Lookup(layout)
+		if t == nil {
+			s.log.e.Println("Error: Layout ", layout, " for ", p, " does not exist.")
+			return errors.New("Layout " + layout + " does not exist.")
+		}
+
+		// Use the current content, other transformers may have changed it.
+		f := s.Files[p]
+		page.Content = template.HTML(f.Content)
+		buf := new(bytes.Buffer)
+		err := t.Execute(buf, page)
+		if err != nil {
+			s.log.e.Println("Error: ", err, " while rendering ", p)
+			return err
+		}
+		f.Content = buf.Bytes()
+		f.ETag = computeETag(f.Content)
+	}
+	return nil
+}
+
+// renderMarkdown converts Markdown to HTML. This is a small renderer that handles the common parts of the syntax:
+// ATX and setext headings, paragraphs, block quotes, ordered and unordered lists (which may be nested), fenced and
+// indented code blocks, horizontal rules, emphasis, inline code, links, images, and hard line breaks. Raw HTML is
+// escaped like any other text, and link and image URLs with unsafe schemes are replaced, see safeURL.
+func renderMarkdown(src []byte) []byte {
+	text := strings.ReplaceAll(string(src), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\t", "    ")
+
+	out := new(bytes.Buffer)
+	renderBlocks(out, strings.Split(text, "\n"))
+	return out.Bytes()
+}
+
+var (
+	mdHeading = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdRule    = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdFence   = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([^ \t`]*)")
+	mdQuote   = regexp.MustCompile(`^ {0,3}> ?`)
+	mdBullet  = regexp.MustCompile(`^( {0,3})([-*+])( +|$)`)
+	mdOrdered = regexp.MustCompile(`^( {0,3})([0-9]{1,9})([.)])( +|$)`)
+)
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// listMarker returns the width of the list marker at the start of line and if it is ordered, or 0 if there is none.
+// Also returns the number an ordered item starts with and the marker character, so lists with different markers
+// may be told apart.
+func listMarker(line string) (width int, ordered bool, start int, char string) {
+	if m := mdBullet.FindStringSubmatch(line); m != nil {
+		return len(m[0]), false, 0, m[2]
+	}
+	if m := mdOrdered.FindStringSubmatch(line); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		return len(m[0]), true, n, m[3]
+	}
+	return 0, false, 0, ""
+}
+
+// startsBlock returns true if line begins a block that interrupts a paragraph.
+func startsBlock(line string) bool {
+	if mdHeading.MatchString(line) || mdRule.MatchString(line) || mdFence.MatchString(line) || mdQuote.MatchString(line) {
+		return true
+	}
+	w, _, _, _ := listMarker(line)
+	return w != 0 && !isBlank(line[w:])
+}
+
+// dedent removes up to n leading spaces from line.
+func dedent(line string, n int) string {
+	i := 0
+	for i < n && i < len(line) && line[i] == ' ' {
+		i++
+	}
+	return line[i:]
+}
+
+func renderBlocks(out *bytes.Buffer, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		switch {
+		case isBlank(line):
+			i++
+
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			indent := len(line) - len(strings.TrimLeft(line, " "))
+			i++
+			code := []string{}
+			for ; i < len(lines); i++ {
+				if t := strings.TrimSpace(lines[i]); strings.HasPrefix(t, m[1][:1]) && strings.Trim(t, m[1][:1]) == "" && len(t) >= len(m[1]) {
+					i++
+					break
+				}
+				code = append(code, dedent(lines[i], indent))
+			}
+			out.WriteString("<pre><code")
+			if m[2] != "" {
+				out.WriteString(` class="language-` + html.EscapeString(m[2]) + `"`)
+			}
+			out.WriteString(">")
+			for _, l := range code {
+				out.WriteString(html.EscapeString(l) + "\n")
+			}
+			out.WriteString("</code></pre>\n")
+
+		case strings.HasPrefix(line, "    "):
+			code := []string{}
+			for ; i < len(lines) && (strings.HasPrefix(lines[i], "    ") || isBlank(lines[i])); i++ {
+				code = append(code, dedent(lines[i], 4))
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			out.WriteString("<pre><code>")
+			for _, l := range code {
+				out.WriteString(html.EscapeString(l) + "\n")
+			}
+			out.WriteString("</code></pre>\n")
+
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			n := strconv.Itoa(len(m[1]))
+			out.WriteString("<h" + n + ">" + renderInline(m[2]) + "</h" + n + ">\n")
+			i++
+
+		case mdRule.MatchString(line):
+			out.WriteString("<hr>\n")
+			i++
+
+		case mdQuote.MatchString(line):
+			quoted := []string{}
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				if mdQuote.MatchString(lines[i]) {
+					quoted = append(quoted, mdQuote.ReplaceAllString(lines[i], ""))
+				} else if len(quoted) > 0 && !startsBlock(lines[i]) {
+					quoted = append(quoted, lines[i]) // Lazy continuation.
+				} else {
+					break
+				}
+			}
+			out.WriteString("<blockquote>\n")
+			renderBlocks(out, quoted)
+			out.WriteString("</blockquote>\n")
+
+		default:
+			if w, _, _, _ := listMarker(line); w != 0 {
+				i = renderList(out, lines, i)
+				continue
+			}
+
+			para := []string{strings.TrimLeft(line, " ")}
+			i++
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				t := strings.TrimSpace(lines[i])
+				if strings.Trim(t, "=") == "" {
+					out.WriteString("<h1>" + renderInline(strings.TrimSpace(strings.Join(para, "\n"))) + "</h1>\n")
+					para = nil
+					i++
+					break
+				}
+				if strings.Trim(t, "-") == "" && len(para) > 0 {
+					out.WriteString("<h2>" + renderInline(strings.TrimSpace(strings.Join(para, "\n"))) + "</h2>\n")
+					para = nil
+					i++
+					break
+				}
+				if startsBlock(lines[i]) {
+					break
+				}
+				para = append(para, strings.TrimLeft(lines[i], " "))
+			}
+			if para != nil {
+				out.WriteString("<p>" + renderInline(strings.TrimRight(strings.Join(para, "\n"), " ")) + "</p>\n")
+			}
+		}
+	}
+}
+
+// renderList renders the list starting at lines[i] and returns the index of the first line after it.
+func renderList(out *bytes.Buffer, lines []string, i int) int {
+	_, ordered, start, char := listMarker(lines[i])
+
+	items := [][]string{}
+	loose := false
+	for i < len(lines) {
+		w, o, _, c := listMarker(lines[i])
+		if w == 0 || o != ordered || c != char {
+			break
+		}
+
+		item := []string{lines[i][w:]}
+		i++
+		for i < len(lines) {
+			line := lines[i]
+			if isBlank(line) {
+				// A blank line only continues the item if the next line is indented to match.
+				j := i
+				for j < len(lines) && isBlank(lines[j]) {
+					j++
+				}
+				if j < len(lines) && strings.HasPrefix(lines[j], strings.Repeat(" ", w)) {
+					loose = true
+					for ; i < j; i++ {
+						item = append(item, "")
+					}
+					continue
+				}
+				if j < len(lines) {
+					if nw, no, _, nc := listMarker(lines[j]); nw != 0 && no == ordered && nc == char {
+						loose = true
+					}
+				}
+				i = j
+				break
+			}
+			if strings.HasPrefix(line, strings.Repeat(" ", w)) {
+				item = append(item, line[w:])
+			} else if mw, _, _, _ := listMarker(line); mw == 0 && !startsBlock(line) {
+				item = append(item, strings.TrimLeft(line, " ")) // Lazy continuation.
+			} else {
+				break
+			}
+			i++
+		}
+		items = append(items, item)
+		if i > 0 && isBlank(lines[i-1]) && !loose {
+			break
+		}
+	}
+
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	out.WriteString("<" + tag)
+	if ordered && start != 1 {
+		out.WriteString(` start="` + strconv.Itoa(start) + `"`)
+	}
+	out.WriteString(">\n")
+	for _, item := range items {
+		buf := new(bytes.Buffer)
+		renderBlocks(buf, item)
+		content := buf.String()
+		if !loose {
+			// Tight lists do not wrap their items in paragraphs.
+			content = strings.TrimSuffix(strings.Replace(content, "<p>", "", 1), "\n")
+			content = strings.Replace(content, "</p>", "", 1)
+		}
+		out.WriteString("<li>" + content + "</li>\n")
+	}
+	out.WriteString("</" + tag + ">\n")
+	return i
+}
+
+const mdPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+func isAlnum(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// findClose finds the closing delimiter for emphasis opened with delim, which must not follow a space. Stronger
+// delimiters (as in "*a **b** c*") and code spans are skipped.
+func findClose(s string, delim string) int {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '`':
+			end := strings.Index(s[i+1:], "`")
+			if end >= 0 {
+				i += end + 1
+			}
+		case strings.HasPrefix(s[i:], delim):
+			if i > 0 && s[i-1] != ' ' && s[i-1] != '\n' {
+				after := i + len(delim)
+				if after < len(s) && s[after] == delim[0] && len(delim) == 1 {
+					i++ // Part of a stronger delimiter, skip it whole.
+					for i < len(s) && s[i] == delim[0] {
+						i++
+					}
+					i--
+					continue
+				}
+				if delim[0] == '_' && after < len(s) && isAlnum(s[after]) {
+					continue
+				}
+				return i
+			}
+			i += len(delim) - 1
+		}
+	}
+	return -1
+}
+
+// parseLink parses "[text](url "title")" starting at s[0] == '['. Returns the parts and the length of the link, or 0.
+func parseLink(s string) (text, url, title string, n int) {
+	depth := 0
+	end := -1
+	for i := 0; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				end = i
+			}
+		}
+	}
+	if end < 0 || end+1 >= len(s) || s[end+1] != '(' {
+		return "", "", "", 0
+	}
+	// The destination may contain balanced parentheses, and the title anything but its own quote.
+	close := -1
+	depth = 0
+	for i := end + 2; i < len(s) && close < 0; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"', '\'':
+			if q := strings.IndexByte(s[i+1:], s[i]); q >= 0 && isSpace(s[i-1]) {
+				i += q + 1
+			}
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				close = i - end - 2
+			}
+			depth--
+		}
+	}
+	if close < 0 {
+		return "", "", "", 0
+	}
+	dest := strings.TrimSpace(s[end+2 : end+2+close])
+	if i := strings.IndexAny(dest, " \t\n"); i >= 0 {
+		title = strings.Trim(strings.TrimSpace(dest[i:]), `"'`)
+		dest = dest[:i]
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+	return s[1:end], dest, title, end + 3 + close
+}
+
+// safeURL returns url, or "#ZgotmplZ" (like html/template) if it has a scheme other than http, https, or mailto.
+func safeURL(url string) string {
+	if i := strings.IndexByte(url, ':'); i >= 0 && !strings.ContainsAny(url[:i], "/?#") {
+		switch strings.ToLower(url[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return "#ZgotmplZ"
+		}
+	}
+	return url
+}
+
+func renderInline(s string) string {
+	out := new(strings.Builder)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(mdPunctuation, s[i+1]) >= 0:
+			out.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			out.WriteString("<br>\n")
+			i += 2
+			continue
+
+		case c == ' ' && strings.HasPrefix(s[i:], "  \n"):
+			out.WriteString("<br>\n")
+			i += strings.Index(s[i:], "\n") + 1
+			continue
+
+		case c == '`':
+			run := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			delim := s[i : i+run]
+			end := strings.Index(s[i+run:], delim)
+			if end >= 0 {
+				code := strings.ReplaceAll(s[i+run:i+run+end], "\n", " ")
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+					code = code[1 : len(code)-1]
+				}
+				out.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += run + end + run
+				continue
+			}
+			out.WriteString(delim)
+			i += run
+			continue
+
+		case c == '!' && strings.HasPrefix(s[i:], "!["):
+			if text, url, title, n := parseLink(s[i+1:]); n != 0 {
+				out.WriteString(`<img src="` + html.EscapeString(safeURL(url)) + `" alt="` + html.EscapeString(text) + `"`)
+				if title != "" {
+					out.WriteString(` title="` + html.EscapeString(title) + `"`)
+				}
+				out.WriteString(">")
+				i += n + 1
+				continue
+			}
+
+		case c == '[':
+			if text, url, title, n := parseLink(s[i:]); n != 0 {
+				out.WriteString(`<a href="` + html.EscapeString(safeURL(url)) + `"`)
+				if title != "" {
+					out.WriteString(` title="` + html.EscapeString(title) + `"`)
+				}
+				out.WriteString(">" + renderInline(text) + "</a>")
+				i += n
+				continue
+			}
+
+		case c == '<':
+			end := strings.IndexByte(s[i:], '>')
+			if end > 0 {
+				url := s[i+1 : i+end]
+				if !strings.ContainsAny(url, " <\n") && (strings.Contains(url, "://") || strings.HasPrefix(url, "mailto:")) {
+					out.WriteString(`<a href="` + html.EscapeString(safeURL(url)) + `">` + html.EscapeString(url) + "</a>")
+					i += end + 1
+					continue
+				}
+			}
+
+		case c == '*' || c == '_':
+			delim := s[i : i+1]
+			if strings.HasPrefix(s[i:], strings.Repeat(delim, 2)) {
+				delim += delim
+			}
+			after := i + len(delim)
+			opens := after < len(s) && s[after] != ' ' && s[after] != '\n'
+			if c == '_' && i > 0 && isAlnum(s[i-1]) {
+				opens = false
+			}
+			if opens {
+				if end := findClose(s[after:], delim); end >= 0 {
+					tag := "em"
+					if len(delim) == 2 {
+						tag = "strong"
+					}
+					out.WriteString("<" + tag + ">" + renderInline(s[after:after+end]) + "</" + tag + ">")
+					i = after + end + len(delim)
+					continue
+				}
+			}
+			out.WriteString(delim)
+			i += len(delim)
+			continue
+		}
+
+		out.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return out.String()
+}
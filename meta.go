@@ -0,0 +1,117 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "fmt"
+import "strings"
+
+// FrontMatterTags lists the tags of files that may start with front matter (see parseFrontMatter for the formats).
+// The front matter is removed from the file's content and put in File.Meta. Files with precompressed versions are left
+// alone, as the precompressed versions would still have the front matter.
+var FrontMatterTags = []string{"HTML", "Markdown"}
+
+// Metadata may also be put in a sidecar file named after the file it is for plus ".meta", for example "about.html.meta"
+// for "about.html". Sidecars may be JSON objects, or TOML or YAML without the delimiters. Keys in a sidecar replace
+// keys of the same name from front matter. Sidecars are resources, and never served.
+//
+// Most keys are just there for templates, see the meta template function and MarkdownPage. These keys change how a
+// static file is served:
+//
+//	path          The URL the file is served at instead of its path in the data directory.
+//	content-type  The Content-Type, this overrides any Policy.
+//	cache         The Cache-Control header, this overrides any Policy.
+//	file-tags     A list of extra tags for the file (see TagsFirst). This is separate from "tags", which is left for
+//	              templates, see MarkdownPage.
+//	redirect      A URL requests for the file are redirected to (with a 301). The file itself is not served.
+
+// loadMeta reads front matter and sidecars into File.Meta, and applies the file-tags key.
+func loadMeta(s *Server) error {
+	for p, f := range s.Files {
+		if len(f.Encoded) != 0 {
+			continue
+		}
+		for _, tag := range FrontMatterTags {
+			if !f.Tags[tag] {
+				continue
+			}
+			meta, body, err := parseFrontMatter(f.Content)
+			if err != nil {
+				s.log.e.Println("Error: ", err, " while reading front matter in ", p)
+				return err
+			}
+			if meta != nil {
+				f.Meta = meta
+				f.Content = body
+				f.ETag = computeETag(body)
+			}
+			break
+		}
+	}
+
+	for p, f := range s.Files {
+		if !strings.HasSuffix(f.Name, ".meta") {
+			continue
+		}
+		f.Tags["Resource"] = true
+
+		orig, ok := s.Files[strings.TrimSuffix(p, ".meta")]
+		if !ok {
+			s.log.i.Println("Metadata file ", p, " has no file to go with it.")
+			continue
+		}
+		meta, err := parseMeta(f.Content)
+		if err != nil {
+			s.log.e.Println("Error: ", err, " while reading ", p)
+			return err
+		}
+		if orig.Meta == nil {
+			orig.Meta = map[string]interface{}{}
+		}
+		for k, v := range meta {
+			orig.Meta[k] = v
+		}
+	}
+
+	for _, f := range s.Files {
+		applyMetaTags(f)
+	}
+	return nil
+}
+
+// applyMetaTags adds the tags listed by a file's file-tags key to the file.
+func applyMetaTags(f *File) {
+	switch tags := f.Meta["file-tags"].(type) {
+	case []interface{}:
+		for _, tag := range tags {
+			f.Tags[fmt.Sprint(tag)] = true
+		}
+	case string:
+		f.Tags[tags] = true
+	}
+}
+
+// metaString returns a string metadata key, or "".
+func metaString(f *File, key string) string {
+	v, _ := f.Meta[key].(string)
+	return v
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "sort"
+import "strings"
+
+// Handlers that list the methods they allow get some things for free:
+//
+//	* If GET is allowed so is HEAD, the response is generated as if for GET and the body discarded.
+//	* OPTIONS is answered with an Allow header, unless a handler takes OPTIONS itself.
+//	* Anything else is passed to the error handler with a 405.
+//
+// Handlers that accept every method still get OPTIONS answered for them, with anyMethods in the Allow header.
+//
+// Several handlers may share a path as long as they allow different methods.
+
+// endpoint dispatches requests for a single path (or pattern) by method.
+type endpoint struct {
+	s     *Server
+	path  string
+	exact bool // If true reject requests for other paths.
+
+	any     http.HandlerFunc // Handles every method, never set along with methods.
+	methods map[string]http.HandlerFunc
+	implied map[string]bool  // Methods that were added automatically and may be replaced.
+	reject  http.HandlerFunc // serveReject with the server's middleware.
+}
+
+func (e *endpoint) add(methods []string, h http.HandlerFunc) {
+	if methods == nil {
+		e.any = h
+		return
+	}
+
+	for _, m := range methods {
+		m = strings.ToUpper(m)
+		e.methods[m] = h
+		delete(e.implied, m)
+	}
+	if _, ok := e.methods[http.MethodGet]; ok {
+		if _, ok := e.methods[http.MethodHead]; !ok {
+			e.methods[http.MethodHead] = headHandler(e.methods[http.MethodGet])
+			e.implied[http.MethodHead] = true
+		}
+	}
+}
+
+// anyMethods are listed in the Allow header for handlers that accept every method.
+var anyMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// allow returns the value for the Allow header.
+func (e *endpoint) allow() string {
+	methods := []string{}
+	if e.any != nil {
+		methods = append(methods, anyMethods...)
+	}
+	for m := range e.methods {
+		methods = append(methods, m)
+	}
+	if _, ok := e.methods[http.MethodOptions]; !ok {
+		methods = append(methods, http.MethodOptions)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w, _ = track(w)
+
+	if e.exact && r.URL.Path != e.path {
+		if !e.s.fallback(w, r, e.path) {
+			e.reject(w, r)
+		}
+		return
+	}
+
+	if e.any != nil && r.Method != http.MethodOptions {
+		e.any(w, r)
+		return
+	}
+	if h, ok := e.methods[r.Method]; ok {
+		h(w, r)
+		return
+	}
+	e.reject(w, r)
+}
+
+// serveReject handles requests that no handler takes.
+func (e *endpoint) serveReject(w http.ResponseWriter, r *http.Request) {
+	if e.exact && r.URL.Path != e.path {
+		e.s.log.i.Println("Rejecting request for ", r.URL.Path, " in handler for ", e.path)
+		e.s.fail(w, r, http.StatusNotFound, nil)
+		return
+	}
+
+	w.Header().Set("Allow", e.allow())
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	e.s.log.i.Println("Rejecting ", r.Method, " request for ", r.URL.Path, " in handler for ", e.path)
+	e.s.fail(w, r, http.StatusMethodNotAllowed, nil)
+}
+
+// headHandler runs a GET handler for a HEAD request and throws away the body.
+func headHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(headWriter{w}, r)
+	}
+}
+
+type headWriter struct {
+	http.ResponseWriter
+}
+
+func (w headWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w headWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
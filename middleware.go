@@ -0,0 +1,91 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "context"
+import "sort"
+
+// Middleware wraps a handler built by Initialize. It is called once per handler while the server is built, with a
+// description of the route the handler serves.
+type Middleware func(next http.Handler, route *Route) http.Handler
+
+// Route describes what a handler built by Initialize is for.
+type Route struct {
+	// The path or pattern the handler was registered for.
+	Pattern string
+
+	// The kind of handler: "SimpleHandler", "TemplateHandler", "JSONHandler", "NegotiatedHandler", "Static", or
+	// "Redirect". Empty for the responses generated when no handler takes a request (404, 405, and OPTIONS).
+	Handler string
+
+	// The file a Static handler serves (or a Redirect handler redirects to), nil for everything else.
+	File *File
+}
+
+type routeKey struct{}
+
+// CurrentRoute returns the Route of the handler serving the request, or nil if it is not being served by a handler
+// built by Initialize.
+func CurrentRoute(r *http.Request) *Route {
+	route, _ := r.Context().Value(routeKey{}).(*Route)
+	return route
+}
+
+// wrap applies middleware to a handler. The server's middleware always goes outside the local middleware, and the first
+// middleware in a list is the outermost.
+//
+// Panics are recovered both inside the middleware, so middleware sees the 500 sent for a panicking handler, and
+// outside it, so a panicking middleware gets one too.
+func (s *Server) wrap(route *Route, local []Middleware, h http.HandlerFunc) http.HandlerFunc {
+	var next http.Handler = s.recoverer(h)
+	for i := len(local) - 1; i >= 0; i-- {
+		next = local[i](next, route)
+	}
+	for i := len(s.Middleware) - 1; i >= 0; i-- {
+		next = s.Middleware[i](next, route)
+	}
+
+	next = s.recoverer(next)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, route)))
+	}
+}
+
+// tagMiddleware collects the middleware for every tag a file has, in order of tag name.
+func (s *Server) tagMiddleware(f *File) []Middleware {
+	tags := []string{}
+	for tag := range s.TagMiddleware {
+		if f.Tags[tag] {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+
+	rtn := []Middleware{}
+	for _, tag := range tags {
+		rtn = append(rtn, s.TagMiddleware[tag]...)
+	}
+	return rtn
+}
@@ -0,0 +1,379 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "bytes"
+
+// The minifiers are deliberately conservative: they remove comments and whitespace that can not matter, and leave
+// everything else alone. None of them are run by default, add them to Transformers to use them.
+
+// MinifyCSS removes comments and unneeded whitespace from files tagged StyleSheet.
+var MinifyCSS = Transformer{
+	Name: "MinifyCSS",
+	Tags: []string{"StyleSheet"},
+	Transform: func(s *Server, f *File) error {
+		f.Content = minifyCSS(f.Content)
+		return nil
+	},
+}
+
+// MinifyJS removes comments and unneeded whitespace from files tagged JavaScript. Line breaks are kept where they may
+// be needed for automatic semicolon insertion.
+var MinifyJS = Transformer{
+	Name: "MinifyJS",
+	Tags: []string{"JavaScript"},
+	Transform: func(s *Server, f *File) error {
+		f.Content = minifyJS(f.Content)
+		return nil
+	},
+}
+
+// MinifyHTML removes comments and collapses runs of whitespace in files tagged HTML. The contents of pre, textarea,
+// script and style elements, quoted attribute values, and template actions are not changed, so this is safe to use on
+// templates.
+var MinifyHTML = Transformer{
+	Name: "MinifyHTML",
+	Tags: []string{"HTML"},
+	Transform: func(s *Server, f *File) error {
+		f.Content = minifyHTML(f.Content)
+		return nil
+	},
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isIdent(c byte) bool {
+	return c == '_' || c == '$' || c == '\\' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func lastByte(b *bytes.Buffer) byte {
+	if b.Len() == 0 {
+		return 0
+	}
+	return b.Bytes()[b.Len()-1]
+}
+
+// skipQuoted returns the index just past the end of the string starting at src[i].
+func skipQuoted(src []byte, i int) int {
+	q := src[i]
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case q:
+			return i + 1
+		case '\n':
+			if q != '`' {
+				return i
+			}
+		}
+	}
+	return len(src)
+}
+
+func minifyCSS(src []byte) []byte {
+	out := new(bytes.Buffer)
+	space := false
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += end + 4
+			}
+			space = true
+			continue
+		case isSpace(c):
+			space = true
+			i++
+			continue
+		}
+
+		// Spaces are significant in selectors and values, except next to these.
+		last := lastByte(out)
+		if space && last != 0 && bytes.IndexByte([]byte("{};,:("), last) < 0 && bytes.IndexByte([]byte("{};,)"), c) < 0 {
+			out.WriteByte(' ')
+		}
+		space = false
+
+		if c == '"' || c == '\'' {
+			end := skipQuoted(src, i)
+			out.Write(src[i:end])
+			i = end
+			continue
+		}
+		if c == '}' && last == ';' {
+			out.Truncate(out.Len() - 1)
+		}
+		out.WriteByte(c)
+		i++
+	}
+	return out.Bytes()
+}
+
+// regexPrefix returns true if a "/" after out starts a regular expression rather than being a division.
+func regexPrefix(out []byte) bool {
+	i := len(out) - 1
+	for i >= 0 && isSpace(out[i]) {
+		i--
+	}
+	if i < 0 {
+		return true
+	}
+	if !isIdent(out[i]) {
+		return out[i] != ')' && out[i] != ']' && out[i] != '}' && out[i] != '"' && out[i] != '\'' && out[i] != '`'
+	}
+
+	j := i
+	for j >= 0 && isIdent(out[j]) {
+		j--
+	}
+	switch string(out[j+1 : i+1]) {
+	case "return", "typeof", "instanceof", "case", "do", "else", "in", "of", "new", "delete", "void", "throw", "yield", "await":
+		return true
+	}
+	return false
+}
+
+// skipRegex returns the index just past the end of the regular expression literal starting at src[i] (not including
+// the flags, which are copied like any other identifier).
+func skipRegex(src []byte, i int) int {
+	class := false
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '[':
+			class = true
+		case ']':
+			class = false
+		case '/':
+			if !class {
+				return i + 1
+			}
+		case '\n':
+			return i
+		}
+	}
+	return len(src)
+}
+
+// skipTemplate returns the index just past the end of the template literal starting at src[i], including any nested
+// template literals in its substitutions.
+func skipTemplate(src []byte, i int) int {
+	for i++; i < len(src); i++ {
+		switch {
+		case src[i] == '\\':
+			i++
+		case src[i] == '`':
+			return i + 1
+		case src[i] == '$' && i+1 < len(src) && src[i+1] == '{':
+			depth := 0
+			for i++; i < len(src); i++ {
+				switch src[i] {
+				case '{':
+					depth++
+				case '}':
+					depth--
+				case '"', '\'':
+					i = skipQuoted(src, i) - 1
+				case '`':
+					i = skipTemplate(src, i) - 1
+				}
+				if depth == 0 {
+					break
+				}
+			}
+		}
+	}
+	return len(src)
+}
+
+func minifyJS(src []byte) []byte {
+	out := new(bytes.Buffer)
+	space, newline := false, false
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			end := bytes.IndexByte(src[i:], '\n')
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += end
+			}
+			continue
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(src)
+			} else {
+				if bytes.IndexByte(src[i:i+2+end], '\n') >= 0 {
+					newline = true
+				}
+				i += end + 4
+			}
+			space = true
+			continue
+		case isSpace(c):
+			space = true
+			newline = newline || c == '\n'
+			i++
+			continue
+		}
+
+		last := lastByte(out)
+		if newline && last != 0 && bytes.IndexByte([]byte("{;,(["), last) < 0 {
+			out.WriteByte('\n')
+		} else if space && last != 0 && (isIdent(last) && isIdent(c) || last == c && (c == '+' || c == '-') || c == '.' || last == '.' || last == '/' && (c == '/' || c == '*')) {
+			out.WriteByte(' ')
+		}
+		space, newline = false, false
+
+		end := i + 1
+		switch {
+		case c == '"' || c == '\'':
+			end = skipQuoted(src, i)
+		case c == '`':
+			end = skipTemplate(src, i)
+		case c == '/' && regexPrefix(out.Bytes()):
+			end = skipRegex(src, i)
+		}
+		out.Write(src[i:end])
+		i = end
+	}
+	return out.Bytes()
+}
+
+// rawElements are the elements whose contents MinifyHTML does not touch.
+var rawElements = []string{"pre", "textarea", "script", "style"}
+
+// rawElement returns the name of the raw element whose start tag begins at src[i], or "".
+func rawElement(src []byte, i int) string {
+	for _, name := range rawElements {
+		end := i + 1 + len(name)
+		if end < len(src) && bytes.EqualFold(src[i+1:end], []byte(name)) && (isSpace(src[end]) || src[end] == '>' || src[end] == '/') {
+			return name
+		}
+	}
+	return ""
+}
+
+// skipAction returns the index just past the end of the template action starting at src[i]. Strings and comments in
+// the action are skipped, so they may contain "}}".
+func skipAction(src []byte, i int) int {
+	for i += 2; i < len(src); {
+		switch {
+		case bytes.HasPrefix(src[i:], []byte("}}")):
+			return i + 2
+		case bytes.HasPrefix(src[i:], []byte("/*")):
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				return len(src)
+			}
+			i += end + 4
+		case src[i] == '"' || src[i] == '\'' || src[i] == '`':
+			i = skipQuoted(src, i)
+		default:
+			i++
+		}
+	}
+	return len(src)
+}
+
+// skipAttr returns the index just past the end of the quoted attribute value starting at src[i], including any
+// template actions in it.
+func skipAttr(src []byte, i int) int {
+	q := src[i]
+	for i++; i < len(src); {
+		switch {
+		case bytes.HasPrefix(src[i:], []byte("{{")):
+			i = skipAction(src, i)
+		case src[i] == q:
+			return i + 1
+		default:
+			i++
+		}
+	}
+	return len(src)
+}
+
+func minifyHTML(src []byte) []byte {
+	out := new(bytes.Buffer)
+	tag := false // Inside a tag, where quotes start attribute values.
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case bytes.HasPrefix(src[i:], []byte("{{")):
+			end := skipAction(src, i)
+			out.Write(src[i:end])
+			i = end
+		case tag && (c == '"' || c == '\''):
+			end := skipAttr(src, i)
+			out.Write(src[i:end])
+			i = end
+		case bytes.HasPrefix(src[i:], []byte("<!--")) && !bytes.HasPrefix(src[i:], []byte("<!--[if")):
+			end := bytes.Index(src[i+4:], []byte("-->"))
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += end + 7
+			}
+		case isSpace(c):
+			end := i
+			newline := false
+			for end < len(src) && isSpace(src[end]) {
+				newline = newline || src[end] == '\n'
+				end++
+			}
+			if newline {
+				out.WriteByte('\n')
+			} else {
+				out.WriteByte(' ')
+			}
+			i = end
+		case c == '<' && rawElement(src, i) != "":
+			close := []byte("</" + rawElement(src, i))
+			end := i + 1
+			for end < len(src) && !(end+len(close) <= len(src) && bytes.EqualFold(src[end:end+len(close)], close)) {
+				end++
+			}
+			out.Write(src[i:end])
+			i = end
+		default:
+			if c == '<' && i+1 < len(src) && (isIdent(src[i+1]) || src[i+1] == '/' || src[i+1] == '!') {
+				tag = true
+			} else if c == '>' {
+				tag = false
+			}
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return bytes.TrimSpace(out.Bytes())
+}
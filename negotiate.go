@@ -0,0 +1,282 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "html/template"
+import "encoding/xml"
+import "context"
+import "errors"
+import "fmt"
+import "strconv"
+import "strings"
+
+// NegotiatedHandler serves the same data as HTML (with a template), JSON, XML, or plain text, picking whichever the
+// client prefers based on its Accept header. If nothing acceptable is available the error handler is called with 406.
+type NegotiatedHandler struct {
+	// AXIS paths for resources assigned to this Handler. You may use other resources as well,
+	// but anything listed here will be marked off the list of files to serve statically.
+	// See Server.Lookup for the accepted path forms.
+	Resources []string
+
+	// The AXIS path to the template for HTML responses (also list in Resources). If not set HTML is not available.
+	Template string
+	Layout   string // See TemplateHandler.
+
+	// The formats that may be picked: "html", "json", "xml", or "text". If nil, html (if there is a Template) and json.
+	// Only offer xml and text if Data returns something encoding/xml or fmt can handle sensibly, a map can not be
+	// encoded as XML for example.
+	Formats []string
+
+	// Works just like the Data function of a TemplateHandler. Use Format to find out which format was picked.
+	Data func(w http.ResponseWriter, r *http.Request) interface{}
+
+	Path string // The path (or pattern, see Params) this handler is responsible for.
+
+	// If true the format may also be picked by adding an extension to the path, for example "/posts.json" or (for a
+	// pattern ending in a parameter) "/posts/{slug}" matching "/posts/hello.xml". Extensions take precedence over the
+	// Accept header.
+	Extensions bool
+
+	// If true responses are hashed and served with an ETag, so clients may make conditional requests.
+	Validate bool
+
+	// The HTTP methods this handler accepts. If nil only GET (and so HEAD) is accepted.
+	Methods []string
+
+	// Middleware for this handler only. Applied inside the server's middleware.
+	Middleware []Middleware
+}
+
+// Formats a NegotiatedHandler may respond with, in order of preference when the client doesn't care.
+var negotiatedFormats = []struct {
+	name, ext, typ string
+}{
+	{"html", ".html", "text/html"},
+	{"json", ".json", "application/json"},
+	{"xml", ".xml", "application/xml"},
+	{"text", ".txt", "text/plain"},
+}
+
+type formatKey struct{}
+
+// Format returns the format a NegotiatedHandler picked for the request: "html", "json", "xml", or "text".
+func Format(r *http.Request) string {
+	f, _ := r.Context().Value(formatKey{}).(string)
+	return f
+}
+
+func (h *NegotiatedHandler) initalize(fs DataSource, s *Server) error {
+	methods := h.Methods
+	if methods == nil {
+		methods = []string{http.MethodGet}
+	}
+
+	formats := h.Formats
+	if formats == nil {
+		formats = []string{"json"}
+		if h.Template != "" {
+			formats = append(formats, "html")
+		}
+	}
+	available := map[string]bool{}
+	for _, name := range formats {
+		known := false
+		for _, f := range negotiatedFormats {
+			known = known || f.name == name
+		}
+		if !known || (name == "html" && h.Template == "") {
+			s.log.e.Println("Error in NegotiatedHandler for ", h.Path, ": format ", name, " is not available.")
+			return errors.New("Error in NegotiatedHandler for " + h.Path + ": format " + name + " is not available.")
+		}
+		available[name] = true
+	}
+
+	var page *template.Template
+	if available["html"] {
+		var err error
+		page, _, err = s.loadPage(h.Template, h.Layout)
+		if s.ambiguous(err) {
+			return nil // Reported by Initialize once every handler is done.
+		}
+		if err != nil {
+			s.log.e.Println("Error in NegotiatedHandler for ", h.Path, ": ", err)
+			return err
+		}
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+
+		format := ""
+		if h.Extensions {
+			format, r = stripFormatExt(r)
+		}
+		if format == "" {
+			format = negotiateFormat(r.Header.Get("Accept"), available)
+		}
+		if format == "" || !available[format] {
+			s.fail(w, r, http.StatusNotAcceptable, nil)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), formatKey{}, format))
+
+		d := h.Data(w, r)
+		if d == nil {
+			return
+		}
+		d, status, ok := s.unpackData(w, r, d)
+		if !ok {
+			return
+		}
+
+		buf := getBuffer()
+		defer putBuffer(buf)
+		var err error
+		typ := ""
+		switch format {
+		case "html":
+			typ = "text/html; charset=utf-8"
+			err = page.Execute(buf, d)
+		case "json":
+			typ = "application/json; charset=utf-8"
+			err = encodeJSON(buf, d, false, false)
+		case "xml":
+			typ = "application/xml; charset=utf-8"
+			buf.WriteString(xml.Header)
+			err = xml.NewEncoder(buf).Encode(d)
+		case "text":
+			typ = "text/plain; charset=utf-8"
+			_, err = fmt.Fprint(buf, d)
+		}
+		if err != nil {
+			s.fail(w, r, http.StatusInternalServerError, fmt.Errorf("Error in NegotiatedHandler for %v (%v): %w", h.Path, format, err))
+			return
+		}
+
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", typ)
+		}
+		writeBuffered(w, r, status, h.Validate, buf.Bytes())
+	}
+
+	paths := []string{h.Path}
+	if h.Extensions && !isPattern(h.Path) {
+		for _, f := range negotiatedFormats {
+			if available[f.name] {
+				paths = append(paths, h.Path+f.ext)
+			}
+		}
+	}
+	if h.Extensions && isPattern(h.Path) && !strings.HasSuffix(h.Path, "}") {
+		return errors.New("Pattern " + h.Path + " must end with a parameter to use extensions.")
+	}
+
+	for i, p := range paths {
+		resources := h.Resources
+		if i != 0 {
+			resources = nil
+		}
+		err := handlerBoilerplate(p, methods, resources, s)
+		if err != nil {
+			return err
+		}
+		s.handle(p, false, methods, s.wrap(&Route{Pattern: p, Handler: "NegotiatedHandler"}, h.Middleware, handler))
+	}
+	return nil
+}
+
+// stripFormatExt removes a format extension from the request path (and the last path parameter, if any).
+func stripFormatExt(r *http.Request) (string, *http.Request) {
+	for _, f := range negotiatedFormats {
+		if !strings.HasSuffix(r.URL.Path, f.ext) {
+			continue
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = strings.TrimSuffix(r.URL.Path, f.ext)
+		if params := Params(r); params != nil {
+			last := r2.URL.Path[strings.LastIndex(r2.URL.Path, "/")+1:]
+			fixed := map[string]string{}
+			for k, v := range params {
+				if v == last+f.ext {
+					v = last
+				}
+				fixed[k] = v
+			}
+			r2 = r2.WithContext(context.WithValue(r2.Context(), paramsKey{}, fixed))
+		}
+		return f.name, r2
+	}
+	return "", r
+}
+
+// negotiateFormat picks the best available format based on an Accept header.
+func negotiateFormat(accept string, available map[string]bool) string {
+	if strings.TrimSpace(accept) == "" {
+		accept = "*/*"
+	}
+
+	best, bestq, bestspec := "", 0.0, -1
+	for _, f := range negotiatedFormats {
+		if !available[f.name] {
+			continue
+		}
+
+		// Find the most specific matching range for this format, its q value is the one that counts.
+		q, spec := 0.0, -1
+		for _, v := range strings.Split(accept, ",") {
+			parts := strings.Split(v, ";")
+			mt := strings.ToLower(strings.TrimSpace(parts[0]))
+			w := 1.0
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					pw, err := strconv.ParseFloat(param[2:], 64)
+					if err == nil {
+						w = pw
+					}
+				}
+			}
+
+			s := -1
+			switch {
+			case mt == f.typ:
+				s = 2
+			case strings.HasSuffix(mt, "/*") && strings.HasPrefix(f.typ, strings.TrimSuffix(mt, "*")):
+				s = 1
+			case mt == "*/*":
+				s = 0
+			}
+			if s > spec {
+				q, spec = w, s
+			}
+		}
+
+		// Prefer the higher q, then an explicit mention over a wildcard, then the order in negotiatedFormats.
+		if q > bestq || (q == bestq && q > 0 && spec > bestspec) {
+			best, bestq, bestspec = f.name, q, spec
+		}
+	}
+	return best
+}
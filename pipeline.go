@@ -0,0 +1,119 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "bytes"
+import "errors"
+import "sort"
+import "strings"
+
+// Transformer rewrites loaded files before any handlers are built.
+type Transformer struct {
+	Name string   // Used in log messages.
+	Tags []string // The transformer is run on files with any of these tags.
+
+	// Changes the file, usually its Content. The file's ETag is updated afterwards.
+	Transform func(s *Server, f *File) error
+}
+
+// Transformers are run in order on every file with a matching tag, after the data tree is loaded and before any
+// handlers are built. Each transformer sees the output of the ones before it, including any files they add.
+//
+// Resources (layouts, partials and precompressed versions), files with precompressed versions, and files tagged Static
+// are never transformed.
+//
+// MinifyCSS, MinifyJS and MinifyHTML are not in the list by default.
+var Transformers = []Transformer{
+	Bundle,
+	Markdown,
+}
+
+// Bundle concatenates the files listed in a file tagged Bundle (a ".bundle" extension) into a new file with the same
+// name minus the ".bundle", for example "app.js.bundle" creates "app.js". Each line is a name as accepted by
+// Server.Lookup, blank lines and lines starting with "#" are ignored. The bundle file itself becomes a resource.
+var Bundle = Transformer{
+	Name: "Bundle",
+	Tags: []string{"Bundle"},
+	Transform: func(s *Server, f *File) error {
+		name := strings.TrimSuffix(f.Name, ".bundle")
+		full := (&File{Name: name, Source: f.Source}).FullPath()
+		if _, ok := s.Files[full]; ok {
+			return errors.New("Bundle " + f.FullPath() + " would replace " + full)
+		}
+
+		content := new(bytes.Buffer)
+		for _, line := range strings.Split(string(f.Content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			part, err := s.Lookup(line)
+			if err != nil {
+				return err
+			}
+			content.Write(part.Content)
+			if !bytes.HasSuffix(part.Content, []byte("\n")) {
+				content.WriteString("\n")
+			}
+		}
+
+		f.Tags["Resource"] = true
+		s.addFile(&File{
+			Name:     name,
+			Source:   f.Source,
+			Content:  content.Bytes(),
+			Modified: f.Modified,
+		})
+		return nil
+	},
+}
+
+// runTransformers runs the Transformers on every eligible file, in order of full path.
+func runTransformers(s *Server) error {
+	for _, t := range Transformers {
+		paths := []string{}
+		for p, f := range s.Files {
+			if f.Tags["Resource"] || f.Tags["Static"] || len(f.Encoded) != 0 {
+				continue
+			}
+			for _, tag := range t.Tags {
+				if f.Tags[tag] {
+					paths = append(paths, p)
+					break
+				}
+			}
+		}
+		sort.Strings(paths)
+
+		for _, p := range paths {
+			f := s.Files[p]
+			err := t.Transform(s, f)
+			if err != nil {
+				s.log.e.Println("Error: ", err, " while running ", t.Name, " on ", p)
+				return err
+			}
+			f.ETag = computeETag(f.Content)
+		}
+	}
+	return nil
+}
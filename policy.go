@@ -0,0 +1,113 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "sort"
+import "strings"
+import "time"
+import filepath "path"
+
+// Policy controls the headers sent with a static file. See Options.TagPolicies and Options.PathPolicies.
+type Policy struct {
+	CacheControl string        // If set, the Cache-Control header.
+	Expires      time.Duration // If set, an Expires header this far after the time of the request.
+	ContentType  string        // If set, used instead of the type guessed from the file extension.
+	Header       http.Header   // Extra headers, these replace any headers of the same name set by other policies.
+}
+
+// Common policies. Immutable is for files that never change at a given URL, NoCache makes clients
+// revalidate every time they use a file.
+var (
+	Immutable = Policy{CacheControl: "public, max-age=31536000, immutable", Expires: 365 * 24 * time.Hour}
+	NoCache   = Policy{CacheControl: "no-cache"}
+)
+
+// merge applies o on top of p.
+func (p *Policy) merge(o Policy) {
+	if o.CacheControl != "" {
+		p.CacheControl = o.CacheControl
+	}
+	if o.Expires != 0 {
+		p.Expires = o.Expires
+	}
+	if o.ContentType != "" {
+		p.ContentType = o.ContentType
+	}
+	for k, v := range o.Header {
+		if p.Header == nil {
+			p.Header = http.Header{}
+		}
+		p.Header[http.CanonicalHeaderKey(k)] = v
+	}
+}
+
+// apply sets the policy's headers.
+func (p *Policy) apply(w http.ResponseWriter) {
+	for k, v := range p.Header {
+		w.Header()[k] = v
+	}
+	if p.CacheControl != "" {
+		w.Header().Set("Cache-Control", p.CacheControl)
+	}
+	if p.Expires != 0 {
+		w.Header().Set("Expires", time.Now().Add(p.Expires).UTC().Format(http.TimeFormat))
+	}
+}
+
+// relativePath returns the path of f inside the data directory, without a leading slash.
+func (s *Server) relativePath(f *File) string {
+	return strings.TrimPrefix(strings.TrimPrefix(f.FullPath(), s.root), "/")
+}
+
+// policy collects the policies for a file. Tag policies are applied in order of tag name, then path policies in order
+// of pattern, so a path policy always wins over a tag policy. The file's own metadata wins over both.
+func (s *Server) policy(f *File) *Policy {
+	p := &Policy{}
+
+	tags := []string{}
+	for tag := range s.TagPolicies {
+		if f.Tags[tag] {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		p.merge(s.TagPolicies[tag])
+	}
+
+	patterns := []string{}
+	rel := s.relativePath(f)
+	for pattern := range s.PathPolicies {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		p.merge(s.PathPolicies[pattern])
+	}
+
+	p.merge(Policy{CacheControl: metaString(f, "cache"), ContentType: metaString(f, "content-type")})
+	return p
+}
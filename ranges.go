@@ -0,0 +1,188 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "net/textproto"
+import "mime/multipart"
+import "strings"
+import "strconv"
+import "errors"
+import "bytes"
+import "time"
+
+// httpRange is a single byte range from a Range header, resolved against a known content size.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return "bytes " + strconv.FormatInt(r.start, 10) + "-" + strconv.FormatInt(r.start+r.length-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+var errNoOverlap = errors.New("Requested range does not overlap content.")
+
+// parseRange parses a Range header value against a content size. Ranges that are empty or start past the end of the
+// content are dropped, if that leaves nothing errNoOverlap is returned.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("Invalid range.")
+	}
+
+	var ranges []httpRange
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, errors.New("Invalid range.")
+		}
+		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+
+		var r httpRange
+		if start == "" {
+			// Suffix range, the last n bytes.
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("Invalid range.")
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("Invalid range.")
+			}
+			if i >= size {
+				// Valid, but not satisfiable.
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - r.start
+			} else {
+				j, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > j {
+					return nil, errors.New("Invalid range.")
+				}
+				if j >= size {
+					j = size - 1
+				}
+				r.length = j - r.start + 1
+			}
+		}
+		if r.length > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// ifRangeMatch checks an If-Range header against the content's validators. Entity tags must match strongly, dates
+// must match exactly.
+func ifRangeMatch(ir, etag string, modified time.Time) bool {
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return etag != "" && !strings.HasPrefix(ir, "W/") && !strings.HasPrefix(etag, "W/") && ir == etag
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && !modified.IsZero() && modified.Truncate(time.Second).Equal(t)
+}
+
+// serveRanges writes content honoring the request's Range and If-Range headers. Content-Type should already be set.
+//
+// Requests that ask for ranges that do not overlap the content are passed to the error handler with a 416.
+func serveRanges(w http.ResponseWriter, r *http.Request, s *Server, content []byte, etag string, modified time.Time) (int, error) {
+	size := int64(len(content))
+	w.Header().Set("Accept-Ranges", "bytes")
+	whole := func() (int, error) {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		return w.Write(content)
+	}
+
+	rh := r.Header.Get("Range")
+	if rh == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return whole()
+	}
+	if ir := r.Header.Get("If-Range"); ir != "" && !ifRangeMatch(ir, etag, modified) {
+		return whole()
+	}
+
+	ranges, err := parseRange(rh, size)
+	if err == errNoOverlap {
+		w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		s.fail(w, r, http.StatusRequestedRangeNotSatisfiable, nil)
+		return 0, nil
+	}
+	if err != nil {
+		// Syntactically invalid ranges are ignored.
+		return whole()
+	}
+
+	var sum int64
+	for _, ra := range ranges {
+		sum += ra.length
+	}
+	if sum > size {
+		// Asking for more than the whole thing is either silly or abusive, send it once.
+		return whole()
+	}
+
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		w.Header().Set("Content-Range", ra.contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(ra.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		return w.Write(content[ra.start : ra.start+ra.length])
+	}
+
+	typ := w.Header().Get("Content-Type")
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+	for _, ra := range ranges {
+		h := textproto.MIMEHeader{}
+		if typ != "" {
+			h.Set("Content-Type", typ)
+		}
+		h.Set("Content-Range", ra.contentRange(size))
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			return 0, err
+		}
+		part.Write(content[ra.start : ra.start+ra.length])
+	}
+	mw.Close()
+
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusPartialContent)
+	return w.Write(buf.Bytes())
+}
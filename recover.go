@@ -0,0 +1,66 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "fmt"
+import "runtime/debug"
+
+// PanicError is the error passed to the error handler (see RequestError) when a handler panics.
+type PanicError struct {
+	Value interface{} // The value passed to panic.
+	Stack []byte      // The stack of the panicking goroutine.
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprint("Panic: ", err.Value)
+}
+
+// Unwrap returns the panic value if it is an error.
+func (err *PanicError) Unwrap() error {
+	e, _ := err.Value.(error)
+	return e
+}
+
+// recoverer turns panics in h into 500s. The panic and its stack are logged, and if the response has not been started
+// the error handler is called.
+//
+// http.ErrAbortHandler is passed on, as net/http uses it to abort a response on purpose.
+func (s *Server) recoverer(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			err := &PanicError{Value: v, Stack: debug.Stack()}
+			s.log.e.Println("Panic handling ", r.Method, " ", r.URL.Path, ": ", v, "\n", string(err.Stack))
+			s.fail(w, r, http.StatusInternalServerError, err)
+		}()
+		h.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "sort"
+import "time"
+
+// ServeHTTP dispatches to the current Handlers.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Current().Handlers.ServeHTTP(w, r)
+}
+
+// Current returns the most recent version of the server: s itself until Reload succeeds, then the version built by
+// the last successful Reload. Versions are never changed once built, so Files, Handlers and Manifest of the returned
+// Server are safe to use while Reload runs.
+func (s *Server) Current() *Server {
+	if c, ok := s.latest.Load().(*Server); ok {
+		return c
+	}
+	return s
+}
+
+// Changes lists the full AXIS paths of files that differ between two versions of the data tree.
+type Changes struct {
+	Added    []string
+	Removed  []string
+	Modified []string
+}
+
+// Empty returns true if nothing changed.
+func (c *Changes) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Modified) == 0
+}
+
+// Reload reads the data tree again and rebuilds every handler into a new version of the server, then swaps it in.
+// Requests that are already in progress finish with the old version. See Current.
+//
+// If anything goes wrong the error is returned and the server keeps using the old version.
+func (s *Server) Reload() (error, *Changes) {
+	s.reload.Lock()
+	defer s.reload.Unlock()
+
+	s.log.i.Println("Reloading data tree.")
+	ns := &Server{
+		Options:    s.Options,
+		fs:         s.fs,
+		handlers:   s.handlers,
+		log:        s.log,
+		root:       s.root,
+		errhandler: s.errhandler,
+	}
+	err := ns.build()
+	if err != nil {
+		s.log.e.Println("Error: ", err, " while reloading, keeping the old version.")
+		return err, nil
+	}
+
+	cur := s.Current()
+	changes := &Changes{}
+	for p, f := range ns.Files {
+		old, ok := cur.Files[p]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, p)
+		case old.ETag != f.ETag:
+			changes.Modified = append(changes.Modified, p)
+		default:
+			// Nothing changed, so don't make clients download it again.
+			f.Modified = old.Modified
+		}
+	}
+	for p := range cur.Files {
+		if _, ok := ns.Files[p]; !ok {
+			changes.Removed = append(changes.Removed, p)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Modified)
+
+	s.latest.Store(ns)
+
+	s.log.i.Println("Reload done. Added: ", changes.Added, " Removed: ", changes.Removed, " Modified: ", changes.Modified)
+	return nil, changes
+}
+
+// Watch polls the data tree every interval and calls Reload whenever something changed. This is intended for
+// development, as every poll reads the whole tree. Watch blocks until stop is closed, so run it in its own goroutine.
+//
+// Errors are logged, the server keeps running with the last version that worked.
+func (s *Server) Watch(interval time.Duration, stop <-chan struct{}) {
+	// Start from what the current version was built from, so changes made before Watch starts are not missed.
+	last := s.Current().scanned
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := s.scan()
+		if err != nil {
+			s.log.e.Println("Error: ", err, " while watching data tree.")
+			continue
+		}
+		if sameScan(last, current) {
+			continue
+		}
+		last = current
+
+		s.Reload() // Errors are logged by Reload.
+	}
+}
+
+// scan reads the data tree and returns the ETag of every file, keyed by full path.
+func (s *Server) scan() (map[string]string, error) {
+	tmp := &Server{Files: map[string]*File{}, short: map[string][]string{}}
+	err := loadDir(s.fs, s.root, tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	rtn := make(map[string]string, len(tmp.Files))
+	for p, f := range tmp.Files {
+		rtn[p] = f.ETag
+	}
+	return rtn, nil
+}
+
+func sameScan(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for p, etag := range a {
+		if b[p] != etag {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "strconv"
+
+// Response may be returned by the Data function of a TemplateHandler or JSONHandler to control the status code and
+// headers without writing the response by hand.
+type Response struct {
+	Status int         // The status code, 200 if not set.
+	Header http.Header // Headers to add to the response.
+
+	// The data for the template, or the value to encode as JSON.
+	Value interface{}
+
+	// If set the error handler is called instead, with Status if it is set or StatusCode(Err) if not.
+	Err error
+}
+
+// unpackData handles whatever a Data function returned. If ok is false the error handler was called and there is
+// nothing left to do.
+func (s *Server) unpackData(w http.ResponseWriter, r *http.Request, d interface{}) (value interface{}, status int, ok bool) {
+	if v, isResponse := d.(Response); isResponse {
+		d = &v
+	}
+
+	switch v := d.(type) {
+	case error:
+		s.fail(w, r, StatusCode(v), v)
+		return nil, 0, false
+	case *Response:
+		if v.Err != nil {
+			status := v.Status
+			if status == 0 {
+				status = StatusCode(v.Err)
+			}
+			s.fail(w, r, status, v.Err)
+			return nil, 0, false
+		}
+
+		for k, vals := range v.Header {
+			for _, val := range vals {
+				w.Header().Add(k, val)
+			}
+		}
+		status := v.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		return v.Value, status, true
+	}
+	return d, http.StatusOK, true
+}
+
+// writeBuffered writes a fully rendered response. If validate is set successful responses get an ETag.
+func writeBuffered(w http.ResponseWriter, r *http.Request, status int, validate bool, content []byte) (int, error) {
+	if validate && status == http.StatusOK {
+		return serveValidated(w, r, content)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	return w.Write(content)
+}
@@ -0,0 +1,354 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "context"
+import "errors"
+import "sort"
+import "strings"
+
+// Handler paths may be patterns. A pattern segment of the form "{name}" matches any single non-empty path segment,
+// and a final segment of the form "{name...}" matches the rest of the path (which may be empty). For example
+// "/posts/{slug}" or "/files/{path...}". Parameters are available to handlers via Params and Param.
+//
+// Exact paths always win over patterns. Among patterns, segments are compared left to right: a literal segment beats a
+// named one, and a named one beats a wildcard. Two patterns that only differ by parameter names conflict. A path may
+// be both a handler's path and a pattern's prefix (the part before the first parameter), for example "/posts/" and
+// "/posts/{slug}", requests for exactly that path go to the handler.
+
+type paramsKey struct{}
+
+// Params returns the path parameters matched for the request, or nil if its handler was not bound to a pattern.
+func Params(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params
+}
+
+// Param returns a single path parameter, or "" if it does not exist.
+func Param(r *http.Request, name string) string {
+	return Params(r)[name]
+}
+
+type segKind int
+
+const (
+	segLiteral segKind = iota
+	segParam
+	segWildcard
+)
+
+type segment struct {
+	kind segKind
+	val  string // Literal text or parameter name.
+}
+
+type route struct {
+	pattern string
+	prefix  string // Everything before the first parameter, up to and including the last slash.
+	segs    []segment
+	handler http.HandlerFunc
+}
+
+// isPattern returns true if the path contains any parameters.
+func isPattern(path string) bool {
+	return strings.Contains(path, "{")
+}
+
+func parsePattern(pattern string) (*route, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, errors.New("Pattern " + pattern + " does not start with a slash.")
+	}
+
+	rt := &route{pattern: pattern}
+	names := map[string]bool{}
+	parts := strings.Split(pattern[1:], "/")
+	for i, part := range parts {
+		if !strings.ContainsAny(part, "{}") {
+			rt.segs = append(rt.segs, segment{segLiteral, part})
+			continue
+		}
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			return nil, errors.New("Pattern " + pattern + " has a parameter that is not a whole segment.")
+		}
+
+		name, kind := part[1:len(part)-1], segParam
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 {
+				return nil, errors.New("Pattern " + pattern + " has a wildcard that is not the last segment.")
+			}
+			name, kind = strings.TrimSuffix(name, "..."), segWildcard
+		}
+		if name == "" || strings.ContainsAny(name, "{}.") {
+			return nil, errors.New("Pattern " + pattern + " has an invalid parameter name.")
+		}
+		if names[name] {
+			return nil, errors.New("Pattern " + pattern + " uses the parameter " + name + " more than once.")
+		}
+		names[name] = true
+		rt.segs = append(rt.segs, segment{kind, name})
+	}
+
+	rt.prefix = pattern[:strings.Index(pattern, "{")]
+	rt.prefix = rt.prefix[:strings.LastIndex(rt.prefix, "/")+1]
+	return rt, nil
+}
+
+// shape returns the pattern with all parameter names removed. Patterns with the same shape conflict.
+func (rt *route) shape() string {
+	parts := make([]string, len(rt.segs))
+	for i, seg := range rt.segs {
+		switch seg.kind {
+		case segLiteral:
+			parts[i] = seg.val
+		case segParam:
+			parts[i] = "{}"
+		case segWildcard:
+			parts[i] = "{...}"
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// match returns the parameters if the path matches.
+func (rt *route) match(path string) (map[string]string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	params := map[string]string{}
+	for i, seg := range rt.segs {
+		if seg.kind == segWildcard {
+			params[seg.val] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segLiteral:
+			if parts[i] != seg.val {
+				return nil, false
+			}
+		case segParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[seg.val] = parts[i]
+		}
+	}
+	if len(parts) != len(rt.segs) {
+		return nil, false
+	}
+	return params, true
+}
+
+// before defines route priority.
+func (rt *route) before(o *route) bool {
+	for i := 0; i < len(rt.segs) && i < len(o.segs); i++ {
+		if rt.segs[i].kind != o.segs[i].kind {
+			return rt.segs[i].kind < o.segs[i].kind
+		}
+	}
+	if len(rt.segs) != len(o.segs) {
+		return len(rt.segs) > len(o.segs)
+	}
+	return rt.pattern < o.pattern
+}
+
+// router dispatches every pattern, so priority is the same no matter which prefix a request came in on. The ServeMux
+// hands it requests through a prefixRouter for each pattern prefix.
+type router struct {
+	routes []*route
+}
+
+func (rtr *router) add(rt *route) {
+	rtr.routes = append(rtr.routes, rt)
+	sort.SliceStable(rtr.routes, func(i, j int) bool {
+		return rtr.routes[i].before(rtr.routes[j])
+	})
+}
+
+// serve serves the request with the first route that matches, and returns false if there is none.
+func (rtr *router) serve(w http.ResponseWriter, r *http.Request) bool {
+	for _, rt := range rtr.routes {
+		params, ok := rt.match(r.URL.Path)
+		if ok {
+			rt.handler(w, r.WithContext(context.WithValue(r.Context(), paramsKey{}, params)))
+			return true
+		}
+	}
+	return false
+}
+
+// prefixRouter is registered with the ServeMux at a pattern prefix, in place of the endpoint for that path (if any).
+type prefixRouter struct {
+	s        *Server
+	prefix   string
+	e        *endpoint // The handler for the prefix itself, may be nil.
+	notFound http.HandlerFunc
+}
+
+func (pr *prefixRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case pr.e != nil && r.URL.Path == pr.prefix:
+		pr.e.ServeHTTP(w, r)
+	case pr.s.router.serve(w, r):
+	case pr.e != nil && !pr.e.exact:
+		pr.e.ServeHTTP(w, r)
+	case !pr.s.fallback(w, r, pr.prefix):
+		pr.notFound(w, r)
+	}
+}
+
+// fallback serves a request that the ServeMux sent to the handler for prefix, but that handler does not take. The
+// request goes to the first pattern that matches, or else to the loose handler (if any) for the longest prefix
+// shorter than prefix, as if the handler for prefix did not exist. Returns false if nothing takes the request.
+func (s *Server) fallback(w http.ResponseWriter, r *http.Request, prefix string) bool {
+	if s.router.serve(w, r) {
+		return true
+	}
+	for p := parentPath(prefix); p != ""; p = parentPath(p) {
+		if e, ok := s.endpoints[p]; ok && !e.exact {
+			e.ServeHTTP(w, r)
+			return true
+		}
+	}
+	return false
+}
+
+// parentPath returns the path of the directory above the one p is in (or is, with a trailing slash), or "" for "/".
+func parentPath(p string) string {
+	p = strings.TrimSuffix(p, "/")
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return ""
+	}
+	return p[:i+1]
+}
+
+// mountEndpoints registers every endpoint with the ServeMux, once all handlers are known. Endpoints at a pattern prefix
+// are served by that prefix's router. Requests for pattern prefixes without their trailing slash are also sent to the
+// router instead of letting the ServeMux redirect them, unless something else handles that path.
+func (s *Server) mountEndpoints() {
+	paths := []string{}
+	for p := range s.endpoints {
+		if !isPattern(p) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if pr, ok := s.prefixes[p]; ok {
+			pr.e = s.endpoints[p]
+			continue
+		}
+		s.Handlers.Handle(p, s.endpoints[p])
+	}
+
+	prefixes := []string{}
+	for p := range s.prefixes {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	for _, p := range prefixes {
+		s.Handlers.Handle(p, s.prefixes[p])
+
+		bare := strings.TrimSuffix(p, "/")
+		if bare == "" || s.hasHandler[bare] {
+			continue
+		}
+		s.hasHandler[bare] = true
+		s.Handlers.Handle(bare, s.prefixes[p])
+	}
+}
+
+// reservePath checks that nothing else handles the given methods on a path (see handle) and marks the path as taken.
+func (s *Server) reservePath(path string, methods []string) error {
+	key := path
+	if isPattern(path) {
+		rt, err := parsePattern(path)
+		if err != nil {
+			s.log.e.Println("Error: ", err)
+			return err
+		}
+		key = rt.shape()
+
+		s.hasHandler[rt.prefix] = true
+		if _, ok := s.prefixes[rt.prefix]; !ok {
+			s.prefixes[rt.prefix] = nil // Reserved, created by handle.
+		}
+	}
+
+	// Handlers may share a path if they handle different methods.
+	e := s.endpoints[key]
+	if e == nil {
+		s.hasHandler[key] = true
+		return nil
+	}
+	if e.path != path {
+		s.log.e.Println("A handler for ", e.path, " already exists, patterns that only differ by parameter names may not be used together.")
+		return errors.New("A handler for " + e.path + " already exists, patterns that only differ by parameter names may not be used together.")
+	}
+	if e.any != nil || methods == nil {
+		s.log.e.Println("A handler for ", path, " already exists.")
+		return errors.New("A handler for " + path + " already exists.")
+	}
+	for _, m := range methods {
+		if _, ok := e.methods[strings.ToUpper(m)]; ok && !e.implied[strings.ToUpper(m)] {
+			s.log.e.Println("A handler for ", m, " ", path, " already exists.")
+			return errors.New("A handler for " + m + " " + path + " already exists.")
+		}
+	}
+	return nil
+}
+
+// handle registers a handler for some methods on a path that has already been reserved. A nil methods list means
+// every method. Plain paths must be matched exactly (unless loose), patterns are handed to the router. Nothing is
+// registered with the ServeMux until mountEndpoints.
+func (s *Server) handle(path string, loose bool, methods []string, h http.HandlerFunc) {
+	key, pattern := path, isPattern(path)
+	var rt *route
+	if pattern {
+		rt, _ = parsePattern(path) // Already checked by reservePath.
+		key = rt.shape()
+	}
+
+	e := s.endpoints[key]
+	if e == nil {
+		e = &endpoint{s: s, path: path, exact: !loose && !pattern, methods: map[string]http.HandlerFunc{}, implied: map[string]bool{}}
+		e.reject = s.wrap(&Route{Pattern: path}, nil, e.serveReject)
+		s.endpoints[key] = e
+
+		if pattern {
+			rt.handler = e.ServeHTTP
+			if s.prefixes[rt.prefix] == nil {
+				pr := &prefixRouter{s: s, prefix: rt.prefix}
+				pr.notFound = s.wrap(&Route{Pattern: rt.prefix}, nil, func(w http.ResponseWriter, r *http.Request) {
+					s.log.i.Println("Rejecting request for ", r.URL.Path, ", no pattern matches.")
+					s.fail(w, r, http.StatusNotFound, nil)
+				})
+				s.prefixes[rt.prefix] = pr
+			}
+			s.router.add(rt)
+		}
+	}
+	e.add(methods, h)
+}
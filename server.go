@@ -25,26 +25,95 @@ package httphelper
 import "net/http"
 import "strings"
 import "errors"
-
-import "github.com/milochristiansen/axis2"
+import "sort"
+import "time"
+import "sync"
+import "sync/atomic"
+import "html/template"
 
 // This uses a tag system much like Rubble, although I would never have bothered it I didn't already have the
 // code as it is way overkill.
 
 // Server is a convenient holder for the HTTP handlers and the loaded files generated by Initialize.
+//
+// Server is itself an http.Handler that always dispatches to the most recent Handlers. Reload never changes an existing
+// Server, it builds a new version which Current returns, so if you use Reload serve the Server rather than Handlers
+// and use Current to get at Files and Manifest.
+//
+// To set Options create a Server yourself and call its Initialize method rather than the Initialize function.
 type Server struct {
-	//handlers []Handler
-	Files    map[string]*File
+	Options
+
+	Files    map[string]*File // Keyed by full AXIS path, see File.FullPath and Server.Lookup.
 	Handlers *http.ServeMux
 
+	// Maps the unfingerprinted URL of every fingerprinted file to its fingerprinted URL, see Options.FingerprintTags.
+	Manifest map[string]string
+
+	fs       DataSource
+	handlers []Handler
+	latest   atomic.Value // *Server, see Current.
+	reload   sync.Mutex
+
 	log        *logger
+	root       string
+	short      map[string][]string // File name -> full paths of every file with that name.
+	scanned    map[string]string   // Full path -> ETag of every file as loaded, see Watch.
 	hasHandler map[string]bool
+	router     *router                  // Every pattern.
+	prefixes   map[string]*prefixRouter // Pattern prefix -> the router's ServeMux entry.
+	templates  *template.Template       // Shared layouts and partials, clone before use.
+	urls       map[string]string        // Full path -> URL for every static file.
+	endpoints  map[string]*endpoint     // Path or pattern shape -> endpoint.
+	pages      map[string]*MarkdownPage // Full path -> page for every file made from Markdown.
 	errhandler HTTPErrorHandler
+
+	ambiguities *AmbiguousError // Collected while the handlers are built.
 }
 
-// Handler is a SimpleHandler, TemplateHandler, or JSONHandler.
+// Options controls how a Server is built. Options may not be changed after the Server is initialized.
+type Options struct {
+	// File names that are served at the path of the directory that contains them, for example "docs/index.html" is
+	// also served at "/docs/". Requests for the directory without a trailing slash are redirected.
+	IndexFiles []string
+
+	// If true files tagged HTML are also served without their extension, for example "about.html" at "/about".
+	CleanURLs bool
+
+	// If true the real paths of index files and (if CleanURLs is set) HTML files redirect to their shorter form.
+	StrictURLs bool
+
+	// Extra functions for every template. These are added after the built in functions, so they may replace them.
+	Funcs template.FuncMap
+
+	// Middleware for every handler, including static files and the responses sent when no handler takes a request.
+	Middleware []Middleware
+
+	// Middleware for static files with a given tag. Applied inside Middleware.
+	TagMiddleware map[string][]Middleware
+
+	// Header policies for static files with a given tag, for example {"StyleSheet": Immutable, "HTML": NoCache}.
+	TagPolicies map[string]Policy
+
+	// Header policies for static files whose path in the data directory matches a pattern (see path.Match), for
+	// example "fonts/*". These override TagPolicies.
+	PathPolicies map[string]Policy
+
+	// Static files with any of these tags are also served at a URL that includes a hash of their content, for example
+	// "/style.css" at "/style.3f9a1c2b.css". The fingerprinted URL is sent with the Immutable caching headers, so it
+	// should be used wherever possible. The asset template function returns it, and Server.Manifest lists them all.
+	FingerprintTags []string
+
+	// If true requests for the unfingerprinted URL of a fingerprinted file are redirected (with a 302).
+	RedirectUnfingerprinted bool
+
+	// The layout Markdown pages are rendered with if they do not name one, see Markdown.
+	MarkdownLayout string
+}
+
+// Handler is a SimpleHandler, TemplateHandler, JSONHandler, or NegotiatedHandler.
 type Handler interface {
-	initalize(fs *axis2.FileSystem, s *Server) error
+	initalize(fs DataSource, s *Server) error
 }
 
 // File is the internal representation of a loaded file.
@@ -53,6 +122,20 @@ type File struct {
 	Source  string // File path (AXIS syntax, including loc ids).
 	Content []byte
 	Tags    map[string]bool
+
+	ETag     string    // Strong entity tag computed from Content.
+	Modified time.Time // The time the file was loaded, used as its Last-Modified date.
+
+	// Compressed versions of Content keyed by Content-Encoding. See Encodings.
+	Encoded map[string][]byte
+
+	// Metadata from front matter or a sidecar file, nil if there is none. See FrontMatterTags.
+	Meta map[string]interface{}
+}
+
+// NotModified is NotModified called with the file's validators.
+func (f *File) NotModified(w http.ResponseWriter, r *http.Request) bool {
+	return NotModified(w, r, f.ETag, f.Modified)
 }
 
 // Return the full AXIS path of the file.
@@ -63,20 +146,90 @@ func (f *File) FullPath() string {
 	return f.Source + "/" + f.Name
 }
 
+// Lookup finds a loaded file by name. The name may be a full AXIS path, a path relative to the data directory, or
+// a bare file name. Bare file names are only accepted if exactly one loaded file has that name.
+//
+// Lookup always uses the most recent version of the server, see Current.
+func (s *Server) Lookup(name string) (*File, error) {
+	s = s.Current()
+	if f, ok := s.Files[name]; ok {
+		return f, nil
+	}
+	if s.root != "" {
+		if f, ok := s.Files[s.root+"/"+name]; ok {
+			return f, nil
+		}
+	}
+
+	matches := s.short[name]
+	switch len(matches) {
+	case 0:
+		return nil, errors.New("Resource " + name + " does not exist.")
+	case 1:
+		return s.Files[matches[0]], nil
+	default:
+		return nil, &AmbiguousError{Names: map[string][]string{name: matches}}
+	}
+}
+
+// AmbiguousError is returned when one or more bare file names match more than one loaded file.
+type AmbiguousError struct {
+	Names map[string][]string // File name -> full paths of every matching file.
+}
+
+// ambiguous records err if it is an AmbiguousError and returns true. Initialize collects every ambiguous name while
+// building the handlers and reports them all at once, so they can all be fixed in one go.
+func (s *Server) ambiguous(err error) bool {
+	aerr, ok := err.(*AmbiguousError)
+	if !ok {
+		return false
+	}
+	for name, matches := range aerr.Names {
+		s.ambiguities.Names[name] = matches
+	}
+	return true
+}
+
+func (err *AmbiguousError) Error() string {
+	names := make([]string, 0, len(err.Names))
+	for name := range err.Names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msg := "Ambiguous resource names (use a longer path):"
+	for _, name := range names {
+		msg += "\n  " + name + ": " + strings.Join(err.Names[name], ", ")
+	}
+	return msg
+}
+
 // HTTPErrorHandler is a superset of an HTTP handler that also takes a status code. Called whenever the server
-// detects an error. Currently this is only called with 404 errors.
+// detects an error: 404 and 405 for requests that no handler takes, 400 and 413 for bad requests, 416 for bad ranges,
+// 500 for handlers that fail or panic, and whatever status a handler returns with an HTTPError.
+//
+// If the error was caused by a Go error it is available via RequestError.
 type HTTPErrorHandler func(w http.ResponseWriter, r *http.Request, status int)
 
-// Initialize creates a new Server based on the given data directory and handlers.
+// Initialize creates a new Server based on the given data directory and handlers. The data directory is a path
+// in fs, use "" for the root.
 //
 // If there is no handler for "/" one will automatically be created that simply calls the error handler with a 404.
 //
 // The Loggers are optional. If you provide one logger it will be used by everything. Two will be used for info and
 // errors. Only the first two will be used. You may pass nil for any Logger, in which case that kind of message will
 // not be logged.
-func Initialize(fs *axis2.FileSystem, path string, handlers []Handler, errhandler HTTPErrorHandler, log ...Logger) (error, *Server) {
+func Initialize(fs DataSource, path string, handlers []Handler, errhandler HTTPErrorHandler, log ...Logger) (error, *Server) {
 	s := &Server{}
+	err := s.Initialize(fs, path, handlers, errhandler, log...)
+	if err != nil {
+		return err, nil
+	}
+	return nil, s
+}
 
+// Initialize is exactly like the Initialize function, except it uses an existing Server so Options may be set.
+func (s *Server) Initialize(fs DataSource, path string, handlers []Handler, errhandler HTTPErrorHandler, log ...Logger) error {
 	s.log = &logger{}
 	switch len(log) {
 	case 0:
@@ -96,57 +249,128 @@ func Initialize(fs *axis2.FileSystem, path string, handlers []Handler, errhandle
 	}
 
 	s.errhandler = errhandler
+	s.fs = fs
+	s.root = path
+	s.handlers = handlers
 
+	err := s.build()
+	if err != nil {
+		return err
+	}
+	s.latest.Store(s)
+	return nil
+}
+
+// build loads the data tree and sets up all the handlers. Everything it creates belongs to s, so that a failed reload
+// never touches a server that is in use.
+func (s *Server) build() error {
 	// First build a tree of resources
 	s.Files = map[string]*File{}
+	s.short = map[string][]string{}
 	s.log.i.Println("Building data tree.")
-	err := loadDir(fs, path, s)
+	err := loadDir(s.fs, s.root, s)
 	if err != nil {
 		s.log.e.Println("Error: ", err, " while building data tree.")
-		return err, nil
+		return err
+	}
+	s.scanned = make(map[string]string, len(s.Files))
+	for p, f := range s.Files {
+		s.scanned[p] = f.ETag
+	}
+	loadPrecompressed(s)
+	err = loadMeta(s)
+	if err != nil {
+		return err
+	}
+	err = loadTemplates(s)
+	if err != nil {
+		return err
+	}
+	s.pages = map[string]*MarkdownPage{}
+	err = runTransformers(s)
+	if err != nil {
+		return err
 	}
 
 	// Then mark off anything with an handler and set up the handlers.
 	s.log.i.Println("Initializing handlers.")
 	s.hasHandler = map[string]bool{}
+	s.router = &router{}
+	s.prefixes = map[string]*prefixRouter{}
+	s.endpoints = map[string]*endpoint{}
+	s.urls = map[string]string{}
+	s.Manifest = map[string]string{}
 	s.Handlers = http.NewServeMux()
-	for _, h := range handlers {
-		err := h.initalize(fs, s)
+	s.ambiguities = &AmbiguousError{Names: map[string][]string{}}
+	for _, h := range s.handlers {
+		err := h.initalize(s.fs, s)
 		if err != nil {
 			s.log.e.Println("Error: ", err, " while initializing handlers.")
-			return err, nil
+			return err
 		}
 	}
+	if len(s.ambiguities.Names) != 0 {
+		s.log.e.Println("Error: ", s.ambiguities, " while initializing handlers.")
+		return s.ambiguities
+	}
 
-	if !s.hasHandler["/"] {
-		s.Handlers.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			s.log.i.Println("Rejecting request for ", r.URL.Path, " in handler for /")
-			errhandler(w, r, http.StatusNotFound)
-		})
+	// Work out where every static file will be served before rendering Markdown layouts, so they can link to them.
+	for _, f := range s.Files {
+		if !f.Tags["Resource"] {
+			_, s.urls[f.FullPath()] = s.staticPaths(f)
+		}
+	}
+	err = renderPages(s)
+	if err != nil {
+		return err
 	}
 
-	// Finally create handlers for the remaining stuff
+	// Then create handlers for the remaining stuff
 	for _, f := range s.Files {
 		if f.Tags["Resource"] {
 			continue
 		}
 
-		p := strings.TrimPrefix(f.FullPath(), path)
+		err := compressFile(f)
+		if err != nil {
+			s.log.e.Println("Error: ", err, " while compressing ", f.FullPath())
+			return err
+		}
 
-		s.log.i.Println("Building handler for ", p)
-		if s.hasHandler[p] {
-			s.log.e.Println("A handler for ", p, " already exists.")
-			return errors.New("A handler for " + p + " already exists."), nil
+		err = s.mountStatic(f)
+		if err != nil {
+			return err
 		}
+	}
 
-		s.Handlers.HandleFunc(p, staticPageHandler(f, s, p))
+	s.mountEndpoints()
+
+	// Finally, if nothing (not even an index file) claimed "/", make sure everything else gets a 404.
+	if !s.hasHandler["/"] {
+		s.Handlers.HandleFunc("/", s.wrap(&Route{Pattern: "/"}, nil, func(w http.ResponseWriter, r *http.Request) {
+			s.log.i.Println("Rejecting request for ", r.URL.Path, " in handler for /")
+			s.fail(w, r, http.StatusNotFound, nil)
+		}))
 	}
+	return nil
+}
 
-	return nil, s
+// addFile adds a file to the data tree. The file's tags and ETag are filled in, Modified should already be set.
+func (s *Server) addFile(f *File) {
+	if f.Tags == nil {
+		f.Tags = map[string]bool{}
+	}
+	for _, tag := range GetFileTags(f.Name) {
+		f.Tags[tag] = true
+	}
+	f.ETag = computeETag(f.Content)
+
+	s.Files[f.FullPath()] = f
+	s.short[f.Name] = append(s.short[f.Name], f.FullPath())
 }
 
 // Recursive file loader.
-func loadDir(fs *axis2.FileSystem, path string, s *Server) error {
+func loadDir(fs DataSource, path string, s *Server) error {
 	dirpath := path
 	if path != "" {
 		path += "/"
@@ -162,12 +386,12 @@ func loadDir(fs *axis2.FileSystem, path string, s *Server) error {
 			return err
 		}
 
-		file := &File{filepath, dirpath, content, map[string]bool{}}
-		tags := GetFileTags(filepath)
-		for _, tag := range tags {
-			file.Tags[tag] = true
-		}
-		s.Files[filepath] = file
+		s.addFile(&File{
+			Name:     filepath,
+			Source:   dirpath,
+			Content:  content,
+			Modified: time.Now(),
+		})
 	}
 
 	for _, dir := range fs.ListDirs(dirpath) {
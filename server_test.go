@@ -25,80 +25,1871 @@ package httphelper
 import "net/http"
 import "net/http/httptest"
 import "testing"
+import "strings"
+import "errors"
+import "encoding/xml"
+import "strconv"
+import "encoding/json"
+import "time"
+import "html/template"
+import "io"
+import "io/ioutil"
+import "mime"
+import "mime/multipart"
+import "os"
+import "fmt"
+import "log"
+import "path/filepath"
+import "testing/fstest"
+import "reflect"
 
+import "bytes"
+import "archive/zip"
+import "compress/gzip"
 import "encoding/base64"
 
 import "github.com/milochristiansen/axis2"
-import "github.com/milochristiansen/axis2/sources/zip"
+import "github.com/milochristiansen/axis2/sources"
+import axiszip "github.com/milochristiansen/axis2/sources/zip"
 
 func TestStaticOcclusion(t *testing.T) {
-	server := getTestServer(t)
+	forEachTestServer(t, func(t *testing.T, server *Server) {
+		req, err := http.NewRequest("GET", "/dont-serve.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	req, err := http.NewRequest("GET", "/dont-serve.txt", nil)
+		rr := httptest.NewRecorder()
+		handler, pattern := server.Handlers.Handler(req)
+		if pattern == "" {
+			// This should be impossible, because the / handler will catch it.
+			t.Fatal("No handler found.")
+		}
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func TestTemplates(t *testing.T) {
+	forEachTestServer(t, func(t *testing.T, server *Server) {
+		req, err := http.NewRequest("GET", "/template", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler, pattern := server.Handlers.Handler(req)
+		if pattern == "" {
+			// This should be impossible, because the / handler will catch it.
+			t.Fatal("No handler found.")
+		}
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusOK, rr.Code)
+		}
+		if rr.Body.String() != "test" {
+			t.Errorf("Wrong body. Expected %q, got %q", "test", rr.Body.String())
+		}
+
+		// Double check resource occlusion while we are here:
+		req, err = http.NewRequest("GET", "/template.html", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr = httptest.NewRecorder()
+		handler, pattern = server.Handlers.Handler(req)
+		if pattern == "" {
+			// This should be impossible, because the / handler will catch it.
+			t.Fatal("No handler found.")
+		}
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func TestStatic(t *testing.T) {
+	forEachTestServer(t, func(t *testing.T, server *Server) {
+		req, err := http.NewRequest("GET", "/static.css", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler, pattern := server.Handlers.Handler(req)
+		if pattern == "" {
+			// This should be impossible, because the / handler will catch it.
+			t.Fatal("No handler found.")
+		}
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusOK, rr.Code)
+		}
+		if rr.Body.String() != "This is a static file" {
+			t.Errorf("Wrong body. Expected %q, got %q", "This is a static file", rr.Body.String())
+		}
+	})
+}
+
+func TestDuplicateNames(t *testing.T) {
+	srcs := getTestSources(t, map[string]string{
+		"blog/index.html": "blog",
+		"docs/index.html": "docs",
+		"blog/post.tmpl":  "blog",
+		"docs/post.tmpl":  "docs",
+		"blog/feed.xml":   "blog",
+		"docs/feed.xml":   "docs",
+	})
+
+	for name, fs := range srcs {
+		t.Run(name, func(t *testing.T) {
+			err, server := Initialize(fs, "resources", nil, errorHandler)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, p := range []string{"blog", "docs"} {
+				rr := serveTest(t, server, "GET", "/"+p+"/index.html")
+				if rr.Body.String() != p {
+					t.Errorf("Wrong body for %v. Expected %q, got %q", p, p, rr.Body.String())
+				}
+			}
+
+			_, err = server.Lookup("blog/index.html")
+			if err != nil {
+				t.Errorf("Relative lookup failed: %v", err)
+			}
+
+			err, _ = Initialize(fs, "resources", []Handler{
+				&SimpleHandler{
+					Resources: []string{"index.html"},
+					Path:      "/simple",
+					Logic:     http.NotFoundHandler(),
+				},
+			}, errorHandler)
+			if _, ok := err.(*AmbiguousError); !ok {
+				t.Errorf("Expected an AmbiguousError, got %v", err)
+			}
+
+			// Every ambiguous name should be reported at once, from every handler.
+			err, _ = Initialize(fs, "resources", []Handler{
+				&SimpleHandler{
+					Resources: []string{"index.html"},
+					Path:      "/simple",
+					Logic:     http.NotFoundHandler(),
+				},
+				&TemplateHandler{
+					Template: "post.tmpl",
+					Path:     "/post",
+					Data:     func(w http.ResponseWriter, r *http.Request) interface{} { return "" },
+				},
+				&NegotiatedHandler{
+					Resources: []string{"feed.xml"},
+					Path:      "/feed",
+					Data:      func(w http.ResponseWriter, r *http.Request) interface{} { return "" },
+				},
+			}, errorHandler)
+			aerr, ok := err.(*AmbiguousError)
+			if !ok {
+				t.Fatalf("Expected an AmbiguousError, got %v", err)
+			}
+			for _, name := range []string{"index.html", "post.tmpl", "feed.xml"} {
+				if len(aerr.Names[name]) != 2 {
+					t.Errorf("Expected 2 matches for %v, got %v", name, aerr.Names[name])
+				}
+			}
+		})
+	}
+}
+
+func TestConditional(t *testing.T) {
+	forEachTestServer(t, func(t *testing.T, server *Server) {
+		rr := serveTest(t, server, "GET", "/static.css")
+		etag := rr.Header().Get("ETag")
+		if etag == "" || rr.Header().Get("Last-Modified") == "" {
+			t.Fatalf("Missing validators. Got ETag %q, Last-Modified %q", etag, rr.Header().Get("Last-Modified"))
+		}
+
+		req, err := http.NewRequest("GET", "/static.css", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("If-None-Match", etag)
+		rr = serveRequest(t, server, req)
+		if rr.Code != http.StatusNotModified {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusNotModified, rr.Code)
+		}
+		if rr.Body.Len() != 0 {
+			t.Errorf("Expected empty body, got %q", rr.Body.String())
+		}
+
+		req.Header.Del("If-None-Match")
+		req.Header.Set("If-Modified-Since", rr.Header().Get("Last-Modified"))
+		rr = serveRequest(t, server, req)
+		if rr.Code != http.StatusNotModified {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusNotModified, rr.Code)
+		}
+
+		req.Header.Set("If-None-Match", `"nope"`)
+		rr = serveRequest(t, server, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusOK, rr.Code)
+		}
+	})
+}
+
+func TestRanges(t *testing.T) {
+	forEachTestServer(t, func(t *testing.T, server *Server) {
+		// "This is a static file"
+		req, err := http.NewRequest("GET", "/static.css", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", "bytes=0-3")
+		rr := serveRequest(t, server, req)
+		if rr.Code != http.StatusPartialContent {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusPartialContent, rr.Code)
+		}
+		if rr.Body.String() != "This" {
+			t.Errorf("Wrong body. Expected %q, got %q", "This", rr.Body.String())
+		}
+		if cr := rr.Header().Get("Content-Range"); cr != "bytes 0-3/21" {
+			t.Errorf("Wrong Content-Range. Expected %q, got %q", "bytes 0-3/21", cr)
+		}
+
+		req.Header.Set("Range", "bytes=0-3,-4")
+		rr = serveRequest(t, server, req)
+		if rr.Code != http.StatusPartialContent {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusPartialContent, rr.Code)
+		}
+		typ, params, err := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+		if err != nil || typ != "multipart/byteranges" {
+			t.Fatalf("Wrong Content-Type. Got %q", rr.Header().Get("Content-Type"))
+		}
+		mr := multipart.NewReader(rr.Body, params["boundary"])
+		for _, expected := range []string{"This", "file"} {
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(part)
+			if string(body) != expected {
+				t.Errorf("Wrong part. Expected %q, got %q", expected, string(body))
+			}
+		}
+
+		req.Header.Set("Range", "bytes=100-")
+		rr = serveRequest(t, server, req)
+		if rr.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusRequestedRangeNotSatisfiable, rr.Code)
+		}
+
+		req.Header.Set("Range", "bytes=0-3")
+		req.Header.Set("If-Range", `"stale"`)
+		rr = serveRequest(t, server, req)
+		if rr.Code != http.StatusOK || !strings.HasSuffix(rr.Body.String(), "file") {
+			t.Errorf("Stale If-Range should send everything. Got %v %q", rr.Code, rr.Body.String())
+		}
+	})
+}
+
+func TestCompression(t *testing.T) {
+	page := strings.Repeat("<p>Compress me!</p>", 100)
+	gz, err := gzipEncode([]byte("precompressed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := getTestFS(t, map[string]string{
+		"style.css":    "body {}",
+		"style.css.gz": string(gz),
+		"page.html":    page,
+	})
+
+	err, server := Initialize(fs, "resources", nil, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/style.css", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rr := serveRequest(t, server, req)
+	if rr.Header().Get("Content-Encoding") != "gzip" || rr.Body.String() != string(gz) {
+		t.Errorf("Expected precompressed sibling, got %q %q", rr.Header().Get("Content-Encoding"), rr.Body.String())
+	}
+	if rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Missing Vary header.")
+	}
+
+	rr = serveTest(t, server, "GET", "/style.css.gz")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Wrong response. Expected %v, got %v", http.StatusNotFound, rr.Code)
+	}
+
+	req.URL.Path = "/page.html"
+	rr = serveRequest(t, server, req)
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected page to be compressed at load time.")
+	}
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(zr)
+	if string(body) != page {
+		t.Errorf("Compressed body does not match.")
+	}
+
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	rr = serveRequest(t, server, req)
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != page {
+		t.Errorf("Expected identity fallback.")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.css", "a")
+	write("template.html", "{{ . }}")
+
+	fs := new(axis2.FileSystem)
+	fs.Mount("resources", sources.NewOSDir(dir), false)
+	err, server := Initialize(fs, "resources", []Handler{
+		&TemplateHandler{
+			Resources: []string{"template.html"},
+			Template:  "template.html",
+			Path:      "/template",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return "test"
+			},
+		},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("a.css", "changed")
+	write("b.css", "b")
+	err, changes := server.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Added) != 1 || len(changes.Modified) != 1 || len(changes.Removed) != 0 {
+		t.Errorf("Wrong changes: %+v", changes)
+	}
+
+	for p, expected := range map[string]string{"/a.css": "changed", "/b.css": "b"} {
+		req := httptest.NewRequest("GET", p, nil)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		if rr.Body.String() != expected {
+			t.Errorf("Wrong body for %v. Expected %q, got %q", p, expected, rr.Body.String())
+		}
+	}
+
+	// A broken tree must not replace the working one.
+	err = os.Remove(filepath.Join(dir, "template.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, _ = server.Reload()
+	if err == nil {
+		t.Error("Expected reload to fail.")
+	}
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/template", nil))
+	if rr.Body.String() != "test" {
+		t.Errorf("Old version not kept. Got %q", rr.Body.String())
+	}
+
+	if _, ok := server.Current().Files["resources/b.css"]; !ok || len(server.Files) != 2 {
+		t.Errorf("Versions not kept apart: %v %v", server.Current().Files, server.Files)
+	}
+}
+
+func TestReloadConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "a.css"), []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := new(axis2.FileSystem)
+	fs.Mount("resources", sources.NewOSDir(dir), false)
+	server := &Server{}
+	err = server.Initialize(fs, "resources", []Handler{
+		&SimpleHandler{
+			Path: "/lookup",
+			Logic: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				f, err := server.Lookup("a.css")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				w.Write(f.Content)
+			}),
+		},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Run with -race to be useful.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			err, _ := server.Reload()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/lookup", nil))
+		if rr.Body.String() != "a" || len(server.Current().Files) != 1 {
+			t.Fatalf("Wrong response during reload: %q", rr.Body.String())
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "a.css"), []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := new(axis2.FileSystem)
+	fs.Mount("resources", sources.NewOSDir(dir), false)
+	err, server := Initialize(fs, "resources", nil, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		server.Watch(5*time.Millisecond, stop)
+		close(stopped)
+	}()
+
+	err = ioutil.WriteFile(filepath.Join(dir, "a.css"), []byte("changed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest("GET", "/a.css", nil))
+		if rr.Body.String() == "changed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Change not picked up, still serving %q", rr.Body.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("Watch did not stop.")
+	}
+}
+
+func TestCleanURLs(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"index.html":      "root",
+		"docs/index.html": "docs",
+		"about.html":      "about",
+		"style.css":       "style",
+	})
+
+	server := &Server{Options: Options{
+		IndexFiles: []string{"index.html"},
+		CleanURLs:  true,
+		StrictURLs: true,
+	}}
+	err := server.Initialize(fs, "resources", nil, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p, expected := range map[string]string{"/": "root", "/docs/": "docs", "/about": "about", "/style.css": "style"} {
+		rr := serveTest(t, server, "GET", p)
+		if rr.Code != http.StatusOK || rr.Body.String() != expected {
+			t.Errorf("Wrong response for %v. Expected %v %q, got %v %q", p, http.StatusOK, expected, rr.Code, rr.Body.String())
+		}
+	}
+
+	for p, expected := range map[string]string{"/docs": "/docs/", "/docs/index.html": "/docs/", "/about.html?a=b": "/about?a=b"} {
+		rr := serveTest(t, server, "GET", p)
+		if rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != expected {
+			t.Errorf("Wrong redirect for %v. Expected %q, got %v %q", p, expected, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+
+	rr := serveTest(t, server, "GET", "/docs/missing")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Wrong response. Expected %v, got %v", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"post.html": "post {{ . }}",
+	})
+
+	simple := func(prefix string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(prefix + " " + Param(r, "path")))
+		})
+	}
+	handlers := []Handler{
+		&TemplateHandler{
+			Resources: []string{"post.html"},
+			Template:  "post.html",
+			Path:      "/posts/{slug}",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return Param(r, "slug")
+			},
+		},
+		&JSONHandler{
+			Path: "/posts/{slug}/comments",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return Params(r)
+			},
+		},
+		&SimpleHandler{Path: "/posts/featured", Logic: simple("featured")},
+		&SimpleHandler{Path: "/posts/{path...}", Logic: simple("wild")},
+	}
+	err, server := Initialize(fs, "resources", handlers, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p, expected := range map[string]string{
+		"/posts/hello":          "post hello",
+		"/posts/featured":       "featured ",
+		"/posts/hello/comments": "{\"slug\":\"hello\"}\n",
+		"/posts/a/b/c":          "wild a/b/c",
+		"/posts/":               "wild ",
+	} {
+		rr := serveTest(t, server, "GET", p)
+		if rr.Body.String() != expected {
+			t.Errorf("Wrong body for %v. Expected %q, got %q", p, expected, rr.Body.String())
+		}
+	}
+
+	handlers = append(handlers, &SimpleHandler{Path: "/posts/{other}", Logic: simple("conflict")})
+	err, _ = Initialize(fs, "resources", handlers, errorHandler)
+	if err == nil {
+		t.Error("Expected conflicting patterns to be rejected.")
+	}
+
+	// Requests that no pattern at the longest prefix takes fall back to shorter prefixes.
+	err, server = Initialize(fs, "resources", []Handler{
+		&SimpleHandler{Path: "/a/{path...}", Logic: simple("a")},
+		&SimpleHandler{Path: "/a/b/{path}", Logic: simple("b")},
+		&SimpleHandler{Path: "/c/d/", Logic: simple("exact")},
+		&SimpleHandler{Path: "/c/{path...}", Logic: simple("c")},
+		&SimpleHandler{Path: "/e/", Loose: true, Logic: simple("loose")},
+		&SimpleHandler{Path: "/e/f/{path}", Logic: simple("f")},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, expected := range map[string]string{
+		"/a/b/c":   "b c",
+		"/a/b/c/d": "a b/c/d",
+		"/a/b":     "a b",
+		"/c/d/":    "exact ",
+		"/c/d/e":   "c d/e",
+		"/e/f/g":   "f g",
+		"/e/f/g/h": "loose ",
+		"/e/f":     "loose ",
+	} {
+		rr := serveTest(t, server, "GET", p)
+		if rr.Code != http.StatusOK || rr.Body.String() != expected {
+			t.Errorf("Wrong response for %v. Expected %q, got %v %q", p, expected, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Exact paths at a pattern's prefix win for exactly that path, whichever is registered first.
+	for _, paths := range [][]string{{"/posts/{path}", "/posts/"}, {"/posts/", "/posts/{path}"}, {"/{path}", "/"}, {"/", "/{path}"}} {
+		err, server := Initialize(fs, "resources", []Handler{
+			&SimpleHandler{Path: paths[0], Logic: simple(paths[0])},
+			&SimpleHandler{Path: paths[1], Logic: simple(paths[1])},
+		}, errorHandler)
+		if err != nil {
+			t.Fatalf("Error for %v and %v: %v", paths[0], paths[1], err)
+		}
+		exact, pattern := paths[0], paths[1]
+		if isPattern(exact) {
+			exact, pattern = pattern, exact
+		}
+		for p, expected := range map[string]string{
+			exact:          exact + " ",
+			exact + "x":    pattern + " x",
+			exact + "x/y/": "",
+		} {
+			rr := serveTest(t, server, "GET", p)
+			if expected == "" && rr.Code != http.StatusNotFound {
+				t.Errorf("Wrong response for %v. Expected %v, got %v", p, http.StatusNotFound, rr.Code)
+			}
+			if expected != "" && (rr.Code != http.StatusOK || rr.Body.String() != expected) {
+				t.Errorf("Wrong response for %v. Expected %q, got %v %q", p, expected, rr.Code, rr.Body.String())
+			}
+		}
+	}
+	fs = getTestFS(t, map[string]string{
+		"index.html":      "index",
+		"docs/index.html": "docs",
+	})
+	server = &Server{Options: Options{IndexFiles: []string{"index.html"}}}
+	err = server.Initialize(fs, "resources", []Handler{
+		&SimpleHandler{Path: "/{path}", Logic: simple("root")},
+		&SimpleHandler{Path: "/docs/{path}", Logic: simple("docs")},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, expected := range map[string]string{
+		"/":       "index",
+		"/a":      "root a",
+		"/docs/":  "docs",
+		"/docs/b": "docs b",
+	} {
+		rr := serveTest(t, server, "GET", p)
+		if rr.Code != http.StatusOK || rr.Body.String() != expected {
+			t.Errorf("Wrong response for %v. Expected %q, got %v %q", p, expected, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	forEachTestServer(t, func(t *testing.T, server *Server) {
+		rr := serveTest(t, server, "POST", "/template")
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusMethodNotAllowed, rr.Code)
+		}
+		if rr.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+			t.Errorf("Wrong Allow header. Got %q", rr.Header().Get("Allow"))
+		}
+
+		rr = serveTest(t, server, "DELETE", "/static.css")
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Wrong response. Expected %v, got %v", http.StatusMethodNotAllowed, rr.Code)
+		}
+
+		rr = serveTest(t, server, "OPTIONS", "/static.css")
+		if rr.Code != http.StatusNoContent || rr.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+			t.Errorf("Wrong OPTIONS response. Got %v %q", rr.Code, rr.Header().Get("Allow"))
+		}
+
+		rr = serveTest(t, server, "HEAD", "/static.css")
+		if rr.Code != http.StatusOK || rr.Body.Len() != 0 || rr.Header().Get("Content-Length") != "21" {
+			t.Errorf("Wrong HEAD response. Got %v %q %q", rr.Code, rr.Body.String(), rr.Header().Get("Content-Length"))
+		}
+	})
+
+	fs := getTestFS(t, map[string]string{
+		"items.html": "{{ . }}",
+	})
+	err, server := Initialize(fs, "resources", []Handler{
+		&TemplateHandler{
+			Resources: []string{"items.html"},
+			Template:  "items.html",
+			Path:      "/items",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return "list"
+			},
+		},
+		&JSONHandler{
+			Path:    "/items",
+			Methods: []string{"POST"},
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return "created"
+			},
+		},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for method, expected := range map[string]string{"GET": "list", "POST": "\"created\"\n"} {
+		rr := serveTest(t, server, method, "/items")
+		if rr.Body.String() != expected {
+			t.Errorf("Wrong body for %v. Expected %q, got %q", method, expected, rr.Body.String())
+		}
+	}
+	rr := serveTest(t, server, "PUT", "/items")
+	if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != "GET, HEAD, OPTIONS, POST" {
+		t.Errorf("Wrong response. Got %v %q", rr.Code, rr.Header().Get("Allow"))
+	}
+
+	// Handlers that do not list their methods.
+	data := func(w http.ResponseWriter, r *http.Request) interface{} {
+		return r.Method
+	}
+	err, server = Initialize(fs, "resources", []Handler{
+		&JSONHandler{Path: "/get", Data: data},
+		&JSONHandler{Path: "/post", Data: data, Request: struct{}{}},
+		&SimpleHandler{Path: "/any", Logic: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Method))
+		})},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		method, path string
+		status       int
+		allow        string
+		body         string
+	}{
+		{"GET", "/get", http.StatusOK, "", "\"GET\"\n"},
+		{"DELETE", "/get", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS", ""},
+		{"OPTIONS", "/get", http.StatusNoContent, "GET, HEAD, OPTIONS", ""},
+		{"OPTIONS", "/post", http.StatusNoContent, "GET, HEAD, OPTIONS, POST", ""},
+		{"PUT", "/post", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS, POST", ""},
+		{"DELETE", "/any", http.StatusOK, "", "DELETE"},
+		{"OPTIONS", "/any", http.StatusNoContent, "DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT", ""},
+	} {
+		rr := serveTest(t, server, c.method, c.path)
+		if rr.Code != c.status || rr.Header().Get("Allow") != c.allow || rr.Body.String() != c.body {
+			t.Errorf("Wrong response for %v %v. Expected %v %q %q, got %v %q %q", c.method, c.path, c.status, c.allow, c.body, rr.Code, rr.Header().Get("Allow"), rr.Body.String())
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"broken.html": "{{ .Missing }}",
+	})
+
+	var lastStatus int
+	var lastErr error
+	errhandler := func(w http.ResponseWriter, r *http.Request, status int) {
+		lastStatus, lastErr = status, RequestError(r)
+		w.WriteHeader(status)
+	}
+
+	bad := errors.New("bad input")
+	err, server := Initialize(fs, "resources", []Handler{
+		&SimpleHandler{
+			Path: "/simple",
+			Logic: ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				return NewHTTPError(http.StatusBadRequest, bad)
+			}),
+		},
+		&JSONHandler{
+			Path: "/json",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return NewHTTPError(http.StatusNotFound, nil)
+			},
+		},
+		&TemplateHandler{
+			Resources: []string{"broken.html"},
+			Template:  "broken.html",
+			Path:      "/template",
+			Validate:  true,
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return 5
+			},
+		},
+	}, errhandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := serveTest(t, server, "GET", "/simple")
+	if rr.Code != http.StatusBadRequest || lastStatus != http.StatusBadRequest || !errors.Is(lastErr, bad) {
+		t.Errorf("Wrong error. Got %v %v %v", rr.Code, lastStatus, lastErr)
+	}
+
+	rr = serveTest(t, server, "GET", "/json")
+	if rr.Code != http.StatusNotFound || rr.Body.Len() != 0 {
+		t.Errorf("Wrong error. Got %v %q", rr.Code, rr.Body.String())
+	}
+
+	rr = serveTest(t, server, "GET", "/template")
+	if rr.Code != http.StatusInternalServerError || lastErr == nil {
+		t.Errorf("Wrong error. Got %v %v", rr.Code, lastErr)
+	}
+
+	rr = serveTest(t, server, "POST", "/template")
+	if lastStatus != http.StatusMethodNotAllowed || lastErr != nil {
+		t.Errorf("Wrong error. Got %v %v", lastStatus, lastErr)
+	}
+}
+
+func TestBufferedTemplates(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"page.html": "before {{ .Missing }} after",
+	})
+
+	handlers := []Handler{
+		&TemplateHandler{
+			Resources: []string{"page.html"},
+			Template:  "page.html",
+			Path:      "/page",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				if r.URL.Query().Get("ok") != "" {
+					return struct{ Missing string }{"middle"}
+				}
+				return 5
+			},
+		},
+	}
+	err, server := Initialize(fs, "resources", handlers, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := serveTest(t, server, "GET", "/page")
+	if rr.Code != http.StatusInternalServerError || rr.Body.Len() != 0 {
+		t.Errorf("Expected a clean 500, got %v %q", rr.Code, rr.Body.String())
+	}
+
+	rr = serveTest(t, server, "GET", "/page?ok=1")
+	if rr.Code != http.StatusOK || rr.Body.String() != "before middle after" {
+		t.Errorf("Wrong response. Got %v %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Length") != "19" || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Wrong headers. Got %v", rr.Header())
+	}
+
+	handlers[0].(*TemplateHandler).Stream = true
+	err, server = Initialize(fs, "resources", handlers, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = serveTest(t, server, "GET", "/page")
+	if rr.Body.String() != "before " {
+		t.Errorf("Expected a partial page when streaming, got %q", rr.Body.String())
+	}
+}
+
+func TestLayouts(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"base.layout.html": `<h1>{{ block "title" . }}Default{{ end }}</h1>{{ template "nav" . }}{{ block "content" . }}{{ end }}`,
+		"nav.partial.html": `[nav]`,
+		"page.html":        `{{ define "title" }}Page{{ end }}{{ define "content" }}{{ . }}{{ end }}`,
+		"other.html":       `{{ define "content" }}other{{ end }}`,
+		"plain.html":       `{{ template "nav" . }} plain`,
+	})
+
+	data := func(w http.ResponseWriter, r *http.Request) interface{} {
+		return "body"
+	}
+	err, server := Initialize(fs, "resources", []Handler{
+		&TemplateHandler{Resources: []string{"page.html"}, Template: "page.html", Layout: "base", Path: "/page", Data: data},
+		&TemplateHandler{Resources: []string{"other.html"}, Template: "other.html", Layout: "base", Path: "/other", Data: data},
+		&TemplateHandler{Resources: []string{"plain.html"}, Template: "plain.html", Path: "/plain", Data: data},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p, expected := range map[string]string{
+		"/page":             "<h1>Page</h1>[nav]body",
+		"/other":            "<h1>Default</h1>[nav]other",
+		"/plain":            "[nav] plain",
+		"/base.layout.html": "",
+		"/nav.partial.html": "",
+	} {
+		rr := serveTest(t, server, "GET", p)
+		if rr.Body.String() != expected {
+			t.Errorf("Wrong body for %v. Expected %q, got %q", p, expected, rr.Body.String())
+		}
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"css/style.css": "body {}",
+		"icon.html":     "<b>icon</b>",
+		"page.html":     `{{ asset "style.css" }}|{{ embed "icon.html" }}|<script>{{ json . }}</script>|{{ number 2 1234567.891 }}|{{ date "2006" .When }}|{{ pathJoin "/a" "../b" }}|{{ shout "hi" }}`,
+	})
+
+	server := &Server{Options: Options{
+		Funcs: template.FuncMap{"shout": strings.ToUpper},
+	}}
+	err := server.Initialize(fs, "resources", []Handler{
+		&TemplateHandler{
+			Resources: []string{"page.html", "icon.html"},
+			Template:  "page.html",
+			Path:      "/page",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return struct{ When time.Time }{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+			},
+		},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := serveTest(t, server, "GET", "/page")
+	expected := `/css/style.css|<b>icon</b>|<script>{"When":"2020-01-01T00:00:00Z"}</script>|1,234,567.89|2020|/b|HI`
+	if rr.Body.String() != expected {
+		t.Errorf("Wrong body. Expected %q, got %q", expected, rr.Body.String())
+	}
+}
+
+func TestResponses(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"post.html": "{{ . }}",
+	})
+
+	err, server := Initialize(fs, "resources", []Handler{
+		&TemplateHandler{
+			Resources: []string{"post.html"},
+			Template:  "post.html",
+			Path:      "/post",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return &Response{Status: http.StatusNotFound, Header: http.Header{"X-Test": {"yes"}}, Value: "no such post"}
+			},
+		},
+		&JSONHandler{
+			Path: "/api/post",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return Response{Status: http.StatusNotFound, Value: map[string]string{"error": "no such post"}}
+			},
+		},
+		&JSONHandler{
+			Path: "/api/fail",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return &Response{Status: http.StatusConflict, Err: errors.New("conflict")}
+			},
+		},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := serveTest(t, server, "GET", "/post")
+	if rr.Code != http.StatusNotFound || rr.Body.String() != "no such post" || rr.Header().Get("X-Test") != "yes" {
+		t.Errorf("Wrong response. Got %v %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	rr = serveTest(t, server, "GET", "/api/post")
+	if rr.Code != http.StatusNotFound || rr.Body.String() != "{\"error\":\"no such post\"}\n" {
+		t.Errorf("Wrong response. Got %v %q", rr.Code, rr.Body.String())
+	}
+
+	rr = serveTest(t, server, "GET", "/api/fail")
+	if rr.Code != http.StatusConflict || rr.Body.Len() != 0 {
+		t.Errorf("Wrong response. Got %v %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestDecoding(t *testing.T) {
+	type post struct {
+		Title string
+	}
+
+	err, server := Initialize(getTestFS(t, nil), "resources", []Handler{
+		&JSONHandler{
+			Path:         "/api/post",
+			Methods:      []string{"POST"},
+			Request:      post{},
+			MaxBodySize:  64,
+			Strict:       true,
+			ErrorHandler: JSONError,
+			Check: func(r *http.Request, v interface{}) error {
+				if v.(*post).Title == "" {
+					return errors.New("title is required")
+				}
+				return nil
+			},
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return Body(r).(*post).Title
+			},
+		},
+	}, errorHandler)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	rr := httptest.NewRecorder()
-	handler, pattern := server.Handlers.Handler(req)
-	if pattern == "" {
-		// This should be impossible, because the / handler will catch it.
-		t.Fatal("No handler found.")
+	for _, c := range []struct {
+		typ, body string
+		status    int
+		expected  string
+	}{
+		{"application/json", `{"Title":"Hello"}`, http.StatusOK, "\"Hello\"\n"},
+		{"text/plain", `{"Title":"Hello"}`, http.StatusUnsupportedMediaType, ""},
+		{"application/json", `{"Title":"Hello","Extra":1}`, http.StatusBadRequest, ""},
+		{"application/json", `{"Title":""}`, http.StatusBadRequest, "title is required"},
+		{"application/json", `{"Title":"` + strings.Repeat("x", 100) + `"}`, http.StatusRequestEntityTooLarge, ""},
+		{"application/json", `{`, http.StatusBadRequest, ""},
+	} {
+		req := httptest.NewRequest("POST", "/api/post", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.typ)
+		rr := serveRequest(t, server, req)
+		if rr.Code != c.status {
+			t.Errorf("Wrong response for %q. Expected %v, got %v", c.body, c.status, rr.Code)
+		}
+		if c.status == http.StatusOK {
+			if rr.Body.String() != c.expected {
+				t.Errorf("Wrong body. Expected %q, got %q", c.expected, rr.Body.String())
+			}
+			continue
+		}
+
+		env := ErrorEnvelope{}
+		err := json.NewDecoder(rr.Body).Decode(&env)
+		if err != nil || env.Error.Status != c.status {
+			t.Errorf("Wrong error envelope for %q: %+v %v", c.body, env, err)
+		}
+		if c.expected != "" && env.Error.Message != c.expected {
+			t.Errorf("Wrong error message. Expected %q, got %q", c.expected, env.Error.Message)
+		}
 	}
-	handler.ServeHTTP(rr, req)
-	if rr.Code != http.StatusNotFound {
-		t.Errorf("Wrong response. Expected %v, got %v", http.StatusNotFound, rr.Code)
+}
+
+func TestJSONOptions(t *testing.T) {
+	data := func(w http.ResponseWriter, r *http.Request) interface{} {
+		return map[string]string{"a": "<b>"}
+	}
+	err, server := Initialize(getTestFS(t, nil), "resources", []Handler{
+		&JSONHandler{Path: "/default", Data: data, PrettyQuery: "pretty"},
+		&JSONHandler{Path: "/raw", Data: data, Pretty: true, RawHTML: true},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p, expected := range map[string]string{
+		"/default":          "{\"a\":\"\\u003cb\\u003e\"}\n",
+		"/default?pretty=1": "{\n\t\"a\": \"\\u003cb\\u003e\"\n}\n",
+		"/raw":              "{\n\t\"a\": \"<b>\"\n}\n",
+	} {
+		rr := serveTest(t, server, "GET", p)
+		if rr.Body.String() != expected {
+			t.Errorf("Wrong body for %v. Expected %q, got %q", p, expected, rr.Body.String())
+		}
+		if rr.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+			t.Errorf("Wrong Content-Type for %v. Got %q", p, rr.Header().Get("Content-Type"))
+		}
 	}
 }
 
-func TestTemplates(t *testing.T) {
-	server := getTestServer(t)
+// TestConcurrency is mostly useful with the race detector (go test -race).
+func TestConcurrency(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"page.html":  "page {{ . }}",
+		"static.css": "static",
+	})
 
-	req, err := http.NewRequest("GET", "/template", nil)
+	type body struct{ N int }
+	err, server := Initialize(fs, "resources", []Handler{
+		&SimpleHandler{
+			Path: "/simple/{n}",
+			Logic: ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if Param(r, "n") == "fail" {
+					return NewHTTPError(http.StatusTeapot, nil)
+				}
+				_, err := w.Write([]byte("simple " + Param(r, "n")))
+				return err
+			}),
+		},
+		&TemplateHandler{
+			Resources: []string{"page.html"},
+			Template:  "page.html",
+			Path:      "/page/{n}",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return Param(r, "n")
+			},
+		},
+		&JSONHandler{
+			Path:    "/json",
+			Request: body{},
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				if b, ok := Body(r).(*body); ok {
+					return b.N
+				}
+				return map[string]interface{}{"bad": func() {}} // Can't be encoded.
+			},
+		},
+	}, errorHandler)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	rr := httptest.NewRecorder()
-	handler, pattern := server.Handlers.Handler(req)
-	if pattern == "" {
-		// This should be impossible, because the / handler will catch it.
-		t.Fatal("No handler found.")
+	done := make(chan struct{})
+	for g := 0; g < 8; g++ {
+		go func(g int) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 50; i++ {
+				n := strconv.Itoa(g*100 + i)
+
+				check := func(req *http.Request, status int, expected string) {
+					rr := httptest.NewRecorder()
+					server.ServeHTTP(rr, req)
+					if rr.Code != status || (expected != "" && rr.Body.String() != expected) {
+						t.Errorf("Wrong response for %v. Expected %v %q, got %v %q", req.URL, status, expected, rr.Code, rr.Body.String())
+					}
+				}
+
+				check(httptest.NewRequest("GET", "/simple/"+n, nil), http.StatusOK, "simple "+n)
+				check(httptest.NewRequest("GET", "/simple/fail", nil), http.StatusTeapot, "")
+				check(httptest.NewRequest("GET", "/page/"+n, nil), http.StatusOK, "page "+n)
+				check(httptest.NewRequest("GET", "/static.css", nil), http.StatusOK, "static")
+
+				req := httptest.NewRequest("POST", "/json", strings.NewReader(`{"N":`+n+`}`))
+				req.Header.Set("Content-Type", "application/json")
+				check(req, http.StatusOK, n+"\n")
+				check(httptest.NewRequest("GET", "/json", nil), http.StatusInternalServerError, "")
+			}
+		}(g)
 	}
-	handler.ServeHTTP(rr, req)
-	if rr.Code != http.StatusOK {
-		t.Errorf("Wrong response. Expected %v, got %v", http.StatusOK, rr.Code)
+	for g := 0; g < 8; g++ {
+		<-done
 	}
-	if rr.Body.String() != "test" {
-		t.Errorf("Wrong body. Expected %q, got %q", "test", rr.Body.String())
+}
+
+func TestNegotiation(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"post.html": "<p>{{ .Title }}</p>",
+	})
+
+	type post struct {
+		Title string
+	}
+	err, server := Initialize(fs, "resources", []Handler{
+		&NegotiatedHandler{
+			Resources:  []string{"post.html"},
+			Template:   "post.html",
+			Path:       "/posts/{slug}",
+			Extensions: true,
+			Formats:    []string{"html", "json", "xml", "text"},
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return post{Param(r, "slug")}
+			},
+		},
+		&NegotiatedHandler{
+			Path: "/data",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return map[string]string{"a": "b"}
+			},
+		},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		path, accept string
+		status       int
+		expected     string
+	}{
+		{"/posts/hi", "", http.StatusOK, "<p>hi</p>"},
+		{"/posts/hi", "text/html,application/xhtml+xml,*/*;q=0.8", http.StatusOK, "<p>hi</p>"},
+		{"/posts/hi", "application/json", http.StatusOK, "{\"Title\":\"hi\"}\n"},
+		{"/posts/hi", "text/*;q=0.5, application/xml", http.StatusOK, xml.Header + "<post><Title>hi</Title></post>"},
+		{"/posts/hi", "text/plain", http.StatusOK, "{hi}"},
+		{"/posts/hi.json", "text/html", http.StatusOK, "{\"Title\":\"hi\"}\n"},
+		{"/posts/hi", "image/png", http.StatusNotAcceptable, ""},
+		{"/data", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", http.StatusOK, "{\"a\":\"b\"}\n"},
+		{"/data", "application/xml", http.StatusNotAcceptable, ""},
+		{"/data", "text/plain", http.StatusNotAcceptable, ""},
+	} {
+		req := httptest.NewRequest("GET", c.path, nil)
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		rr := serveRequest(t, server, req)
+		if rr.Code != c.status || rr.Body.String() != c.expected {
+			t.Errorf("Wrong response for %v %q. Expected %v %q, got %v %q", c.path, c.accept, c.status, c.expected, rr.Code, rr.Body.String())
+		}
+	}
+
+	for _, formats := range [][]string{{"html"}, {"json", "yaml"}} {
+		err, _ := Initialize(fs, "resources", []Handler{
+			&NegotiatedHandler{Path: "/data", Formats: formats},
+		}, errorHandler)
+		if err == nil {
+			t.Errorf("Expected formats %v to be rejected.", formats)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"style.css": "style",
+		"page.html": "{{ . }}",
+	})
+
+	mark := func(name string) Middleware {
+		return func(next http.Handler, route *Route) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Order", name)
+				w.Header().Set("X-Route", route.Handler+" "+route.Pattern)
+				next.ServeHTTP(w, r)
+			})
+		}
 	}
 
-	// Double check resource occlusion while we are here:
-	req, err = http.NewRequest("GET", "/template.html", nil)
+	server := &Server{Options: Options{
+		Middleware:    []Middleware{mark("global1"), mark("global2")},
+		TagMiddleware: map[string][]Middleware{"StyleSheet": {mark("css")}},
+	}}
+	err := server.Initialize(fs, "resources", []Handler{
+		&TemplateHandler{
+			Resources:  []string{"page.html"},
+			Template:   "page.html",
+			Path:       "/page/{n}",
+			Middleware: []Middleware{mark("local")},
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return CurrentRoute(r).Pattern
+			},
+		},
+	}, errorHandler)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	rr = httptest.NewRecorder()
-	handler, pattern = server.Handlers.Handler(req)
-	if pattern == "" {
-		// This should be impossible, because the / handler will catch it.
-		t.Fatal("No handler found.")
+	for _, c := range []struct {
+		method, path string
+		order        string
+		route        string
+		body         string
+	}{
+		{"GET", "/page/1", "global1,global2,local", "TemplateHandler /page/{n}", "/page/{n}"},
+		{"GET", "/style.css", "global1,global2,css", "Static /style.css", "style"},
+		{"POST", "/style.css", "global1,global2", " /style.css", ""},
+		{"GET", "/missing", "global1,global2", " /", ""},
+	} {
+		rr := serveTest(t, server, c.method, c.path)
+		order := strings.Join(rr.Header()["X-Order"], ",")
+		if order != c.order || rr.Header().Get("X-Route") != c.route || rr.Body.String() != c.body {
+			t.Errorf("Wrong response for %v %v. Expected %q %q %q, got %q %q %q", c.method, c.path, c.order, c.route, c.body, order, rr.Header().Get("X-Route"), rr.Body.String())
+		}
 	}
-	handler.ServeHTTP(rr, req)
-	if rr.Code != http.StatusNotFound {
-		t.Errorf("Wrong response. Expected %v, got %v", http.StatusNotFound, rr.Code)
+}
+
+func TestAccessLog(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"style.css": "style",
+	})
+
+	buf := new(bytes.Buffer)
+	server := &Server{Options: Options{
+		Middleware: []Middleware{AccessLog(log.New(buf, "", 0), JSONLogFormat)},
+	}}
+	err := server.Initialize(fs, "resources", []Handler{
+		&SimpleHandler{
+			Path: "/post/{slug}",
+			Logic: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("created"))
+			}),
+		},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		method, path string
+		status       int
+		bytes        int64
+		route        string
+	}{
+		{"GET", "/style.css", 200, 5, "/style.css"},
+		{"POST", "/post/hello?x=1", 201, 7, "/post/{slug}"},
+		{"GET", "/missing", 404, 0, "/"},
+	} {
+		buf.Reset()
+		serveTest(t, server, c.method, c.path)
+
+		entry := AccessLogEntry{}
+		err := json.Unmarshal(buf.Bytes(), &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Method != c.method || entry.URI != c.path || entry.Status != c.status || entry.Bytes != c.bytes || entry.Route != c.route {
+			t.Errorf("Wrong log entry for %v %v: %s", c.method, c.path, buf.String())
+		}
+	}
+
+	entry := &AccessLogEntry{
+		Time:      time.Date(2020, 10, 10, 13, 55, 36, 0, time.UTC),
+		Remote:    "127.0.0.1",
+		User:      "frank",
+		Method:    "GET",
+		URI:       "/apache_pb.gif",
+		Proto:     "HTTP/1.0",
+		Status:    200,
+		Bytes:     2326,
+		Referer:   "http://www.example.com/start.html",
+		UserAgent: "Mozilla/4.08",
+	}
+	common := `127.0.0.1 - frank [10/Oct/2020:13:55:36 +0000] "GET /apache_pb.gif HTTP/1.0" 200 2326`
+	if line := entry.format(CommonLogFormat); line != common {
+		t.Errorf("Wrong common log line: %v", line)
+	}
+	combined := common + ` "http://www.example.com/start.html" "Mozilla/4.08"`
+	if line := entry.format(CombinedLogFormat); line != combined {
+		t.Errorf("Wrong combined log line: %v", line)
 	}
 }
 
-func TestStatic(t *testing.T) {
-	server := getTestServer(t)
+func TestRecovery(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"page.html": "{{ . }}",
+	})
+
+	logs := new(bytes.Buffer)
+	var status int
+	var perr *PanicError
+	eh := func(w http.ResponseWriter, r *http.Request, s int) {
+		status = s
+		errors.As(RequestError(r), &perr)
+		w.WriteHeader(s)
+	}
+
+	server := &Server{Options: Options{
+		Middleware: []Middleware{func(next http.Handler, route *Route) http.Handler {
+			if route.Pattern != "/middleware" {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("middleware")
+			})
+		}},
+	}}
+	err := server.Initialize(fs, "resources", []Handler{
+		&SimpleHandler{
+			Path: "/simple",
+			Logic: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic(errors.New("simple"))
+			}),
+		},
+		&SimpleHandler{
+			Path: "/started",
+			Logic: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("partial"))
+				panic("started")
+			}),
+		},
+		&SimpleHandler{
+			Path:  "/middleware",
+			Logic: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		},
+		&TemplateHandler{
+			Resources: []string{"page.html"},
+			Template:  "page.html",
+			Path:      "/page",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				panic("template")
+			},
+		},
+		&JSONHandler{
+			Path: "/json",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				panic("json")
+			},
+		},
+	}, eh, log.New(logs, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		path   string
+		value  string
+		status int
+		called bool
+	}{
+		{"/simple", "simple", http.StatusInternalServerError, true},
+		{"/page", "template", http.StatusInternalServerError, true},
+		{"/json", "json", http.StatusInternalServerError, true},
+		{"/middleware", "middleware", http.StatusInternalServerError, true},
+		{"/started", "started", http.StatusOK, false},
+	} {
+		status, perr = 0, nil
+		logs.Reset()
+		rr := serveTest(t, server, "GET", c.path)
+		if rr.Code != c.status {
+			t.Errorf("Wrong status for %v. Expected %v, got %v", c.path, c.status, rr.Code)
+		}
+		if c.called && (status != http.StatusInternalServerError || perr == nil || fmt.Sprint(perr.Value) != c.value) {
+			t.Errorf("Error handler not called correctly for %v: %v %v", c.path, status, perr)
+		}
+		if !c.called && status != 0 {
+			t.Errorf("Error handler called for %v after the response started.", c.path)
+		}
+		if !strings.Contains(logs.String(), c.value) || !strings.Contains(logs.String(), "goroutine") {
+			t.Errorf("Panic for %v not logged with a stack: %v", c.path, logs.String())
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"style.css":      "style",
+		"index.html":     "index",
+		"fonts/font.dat": "font",
+	})
+
+	server := &Server{Options: Options{
+		TagPolicies: map[string]Policy{
+			"StyleSheet": Immutable,
+			"HTML":       NoCache,
+		},
+		PathPolicies: map[string]Policy{
+			"fonts/*": {
+				CacheControl: "public, max-age=3600",
+				ContentType:  "font/woff2",
+				Header:       http.Header{"Access-Control-Allow-Origin": {"*"}},
+			},
+		},
+	}}
+	err := server.Initialize(fs, "resources", nil, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		path    string
+		cache   string
+		expires bool
+		typ     string
+		cors    string
+	}{
+		{"/style.css", Immutable.CacheControl, true, "text/css; charset=utf-8", ""},
+		{"/index.html", "no-cache", false, "text/html; charset=utf-8", ""},
+		{"/fonts/font.dat", "public, max-age=3600", false, "font/woff2", "*"},
+	} {
+		rr := serveTest(t, server, "GET", c.path)
+		h := rr.Header()
+		if h.Get("Cache-Control") != c.cache || (h.Get("Expires") != "") != c.expires || h.Get("Content-Type") != c.typ || h.Get("Access-Control-Allow-Origin") != c.cors {
+			t.Errorf("Wrong headers for %v: %v", c.path, h)
+		}
+	}
+
+	// Not modified responses keep the caching headers.
+	f, _ := server.Lookup("style.css")
+	req, _ := http.NewRequest("GET", "/style.css", nil)
+	req.Header.Set("If-None-Match", f.ETag)
+	rr := serveRequest(t, server, req)
+	if rr.Code != http.StatusNotModified || rr.Header().Get("Cache-Control") != Immutable.CacheControl {
+		t.Errorf("Wrong not modified response: %v %v", rr.Code, rr.Header())
+	}
+	expires, err := http.ParseTime(rr.Header().Get("Expires"))
+	if err != nil || expires.Before(time.Now().Add(364*24*time.Hour)) {
+		t.Errorf("Wrong Expires header: %v", rr.Header().Get("Expires"))
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"css/style.css": "style",
+		"page.html":     `{{ asset "style.css" }}`,
+	})
+
+	for _, redirect := range []bool{false, true} {
+		server := &Server{Options: Options{
+			FingerprintTags:         []string{"StyleSheet"},
+			RedirectUnfingerprinted: redirect,
+		}}
+		err := server.Initialize(fs, "resources", []Handler{
+			&TemplateHandler{
+				Resources: []string{"page.html"},
+				Template:  "page.html",
+				Path:      "/",
+				Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+					return true
+				},
+			},
+		}, errorHandler)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, _ := server.Lookup("style.css")
+		fp := "/css/style." + strings.Trim(f.ETag, `"`)[:8] + ".css"
+		if len(server.Manifest) != 1 || server.Manifest["/css/style.css"] != fp {
+			t.Fatalf("Wrong manifest: %v", server.Manifest)
+		}
+
+		rr := serveTest(t, server, "GET", "/")
+		if rr.Body.String() != fp {
+			t.Errorf("Wrong asset URL. Expected %q, got %q", fp, rr.Body.String())
+		}
+
+		rr = serveTest(t, server, "GET", fp)
+		if rr.Code != http.StatusOK || rr.Body.String() != "style" || rr.Header().Get("Cache-Control") != Immutable.CacheControl {
+			t.Errorf("Wrong fingerprinted response: %v %q %v", rr.Code, rr.Body.String(), rr.Header())
+		}
+
+		rr = serveTest(t, server, "GET", "/css/style.css")
+		if redirect && (rr.Code != http.StatusFound || rr.Header().Get("Location") != fp) {
+			t.Errorf("Expected redirect to %v, got %v %v", fp, rr.Code, rr.Header().Get("Location"))
+		}
+		if !redirect && (rr.Code != http.StatusOK || rr.Header().Get("Cache-Control") != "") {
+			t.Errorf("Wrong unfingerprinted response: %v %v", rr.Code, rr.Header())
+		}
+	}
+}
+
+func TestTransformers(t *testing.T) {
+	defer func(old []Transformer) { Transformers = old }(Transformers)
+	Transformers = append(Transformers, MinifyCSS, MinifyJS, MinifyHTML)
+
+	fs := getTestFS(t, map[string]string{
+		"a.css":          "a {\n\tcolor: red;\n}\n",
+		"b.css":          "/* b */\nb > i { margin: 0 auto; }",
+		"app.css.bundle": "# Styles\na.css\n\nb.css\n",
+		"app.js":         "// app\nvar x = 1 + +y; /* z */\nreturn x\n",
+		"page.html":      "<p>\n  Hello   <!-- hi -->world\n</p>\n<pre>  a\n  b</pre>",
+		"other.css.gz":   "compressed",
+		"other.css":      "a { color: red; }",
+	})
+
+	err, server := Initialize(fs, "resources", nil, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		path, body string
+	}{
+		{"/app.css", "a{color:red}b > i{margin:0 auto}"},
+		{"/app.js", "var x=1+ +y;return x"},
+		{"/page.html", "<p>\nHello world\n</p>\n<pre>  a\n  b</pre>"},
+		{"/other.css", "a { color: red; }"},
+		{"/app.css.bundle", ""},
+	} {
+		rr := serveTest(t, server, "GET", c.path)
+		if rr.Body.String() != c.body {
+			t.Errorf("Wrong content for %v. Expected %q, got %q", c.path, c.body, rr.Body.String())
+		}
+	}
+
+	f, _ := server.Lookup("app.css")
+	if f.ETag != computeETag(f.Content) || !f.Tags["StyleSheet"] {
+		t.Errorf("Bundle not set up correctly: %v %v", f.ETag, f.Tags)
+	}
+
+	for in, expected := range map[string]string{
+		"@media (min-width: 10px) { a:hover , b { x: calc(1px + 2px) ; } }": "@media (min-width:10px){a:hover,b{x:calc(1px + 2px)}}",
+		`a::after { content: "  /* x */  " }`:                               `a::after{content:"  /* x */  "}`,
+	} {
+		if out := string(minifyCSS([]byte(in))); out != expected {
+			t.Errorf("Wrong CSS for %q. Expected %q, got %q", in, expected, out)
+		}
+	}
+	for in, expected := range map[string]string{
+		"var re = /a\\/ // b/g; // c":       "var re=/a\\/ // b/g;",
+		"x = a / b / c / /d/.source":        "x=a/b/c/ /d/.source",
+		"s = `a  ${ `b  ${c}` }  d` + '//'": "s=`a  ${ `b  ${c}` }  d`+'//'",
+		"return /x/.test(y)":                "return/x/.test(y)",
+		"f(a)\n(b)\n{\n  c;\n}":             "f(a)\n(b)\n{c;}",
+	} {
+		if out := string(minifyJS([]byte(in))); out != expected {
+			t.Errorf("Wrong JS for %q. Expected %q, got %q", in, expected, out)
+		}
+	}
+	for in, expected := range map[string]string{
+		`<div title="a   b"  class='c   d'>  x  </div>`:         `<div title="a   b" class='c   d'> x </div>`,
+		`<p>{{ printf "a    b" }}   {{/* "  }}  " */}}</p>`:     `<p>{{ printf "a    b" }} {{/* "  }}  " */}}</p>`,
+		`<a href="{{ .X  "}}" }}  y">don't   "stop"</a>`:        `<a href="{{ .X  "}}" }}  y">don't "stop"</a>`,
+		"<p {{ if gt .N 1 }}  class=\"x  y\"{{ end }}>\n\n</p>": "<p {{ if gt .N 1 }} class=\"x  y\"{{ end }}>\n</p>",
+	} {
+		if out := string(minifyHTML([]byte(in))); out != expected {
+			t.Errorf("Wrong HTML for %q. Expected %q, got %q", in, expected, out)
+		}
+	}
+
+	fs = getTestFS(t, map[string]string{
+		"app.css.bundle": "missing.css",
+	})
+	err, _ = Initialize(fs, "resources", nil, errorHandler)
+	if err == nil {
+		t.Error("Bundle with a missing file did not fail.")
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"docs/intro.md":    "---\ntitle: Intro\ndate: 2020-10-10\ntags: [a, \"b, c\"]\n---\n# Hello\n\nSome *text*.\n",
+		"docs/raw.md":      "---\nlayout: \"\"\n---\nraw",
+		"docs/post.md":     "---\nlayout: \"\"\ntags: [Resource, Static]\n---\npost",
+		"base.layout.html": `<title>{{ .Title }}</title>{{ .Date.Year }} {{ range .Tags }}[{{ . }}]{{ end }}<link href="{{ asset "style.css" }}">{{ .Content }}`,
+		"style.css":        "style",
+	})
+
+	server := &Server{Options: Options{MarkdownLayout: "base", CleanURLs: true}}
+	err := server.Initialize(fs, "resources", nil, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/docs/intro", http.StatusOK, "<title>Intro</title>2020 [a][b, c]<link href=\"/style.css\"><h1>Hello</h1>\n<p>Some <em>text</em>.</p>\n"},
+		{"/docs/raw", http.StatusOK, "<p>raw</p>\n"},
+		{"/docs/intro.md", http.StatusNotFound, ""},
+		{"/docs/post", http.StatusOK, "<p>post</p>\n"},
+	} {
+		rr := serveTest(t, server, "GET", c.path)
+		if rr.Code != c.status || rr.Body.String() != c.body {
+			t.Errorf("Wrong response for %v. Expected %v %q, got %v %q", c.path, c.status, c.body, rr.Code, rr.Body.String())
+		}
+		if c.status == http.StatusOK && rr.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Errorf("Wrong Content-Type for %v: %q", c.path, rr.Header().Get("Content-Type"))
+		}
+	}
+
+	for in, expected := range map[string]string{
+		"Title\n=====\n\nSub\n---":                     "<h1>Title</h1>\n<h2>Sub</h2>\n",
+		"## A *b* ##":                                  "<h2>A <em>b</em></h2>\n",
+		"a **b** _c_ snake_case `<x>` \\*d\\*":         "<p>a <strong>b</strong> <em>c</em> snake_case <code>&lt;x&gt;</code> *d*</p>\n",
+		"[a](/b \"t\") ![c](d.png) <http://e.com> <b>": `<p><a href="/b" title="t">a</a> <img src="d.png" alt="c"> <a href="http://e.com">http://e.com</a> &lt;b&gt;</p>` + "\n",
+		"- a\n- b\n  - c\n- d":                         "<ul>\n<li>a</li>\n<li>b\n<ul>\n<li>c</li>\n</ul></li>\n<li>d</li>\n</ul>\n",
+		"3. a\n4. b":                                   "<ol start=\"3\">\n<li>a</li>\n<li>b</li>\n</ol>\n",
+		"- a\n\n- b":                                   "<ul>\n<li><p>a</p>\n</li>\n<li><p>b</p>\n</li>\n</ul>\n",
+		"> a\nb\n\n---":                                "<blockquote>\n<p>a\nb</p>\n</blockquote>\n<hr>\n",
+		"```go\nif a < b {\n}\n```\n\n    code":        "<pre><code class=\"language-go\">if a &lt; b {\n}\n</code></pre>\n<pre><code>code\n</code></pre>\n",
+		"line  \nbreak":                                "<p>line<br>\nbreak</p>\n",
+		"[x](f(1)) [y](/a_(b) \"c)\")":                 `<p><a href="f(1)">x</a> <a href="/a_(b)" title="c)">y</a></p>` + "\n",
+		"[a](javascript:alert(1)) ![b](Data:x) <javascript://%0aalert(1)>": `<p><a href="#ZgotmplZ">a</a> <img src="#ZgotmplZ" alt="b"> <a href="#ZgotmplZ">javascript://%0aalert(1)</a></p>` + "\n",
+		"[a](/b:c) [d](?e:f) [g](HTTPS://h) [i](mailto:j@k)":               `<p><a href="/b:c">a</a> <a href="?e:f">d</a> <a href="HTTPS://h">g</a> <a href="mailto:j@k">i</a></p>` + "\n",
+	} {
+		if out := string(renderMarkdown([]byte(in))); out != expected {
+			t.Errorf("Wrong HTML for %q. Expected %q, got %q", in, expected, out)
+		}
+	}
+
+	fs = getTestFS(t, map[string]string{
+		"page.md": "---\nlayout: missing\n---\ntext",
+	})
+	err, _ = Initialize(fs, "resources", nil, errorHandler)
+	if err == nil {
+		t.Error("Markdown page with a missing layout did not fail.")
+	}
+}
+
+func TestMeta(t *testing.T) {
+	fs := getTestFS(t, map[string]string{
+		"about.html":      "---\ntitle: About\npath: /about-us\ncache: no-store\n---\nabout",
+		"data.html":       "{\n\"content-type\": \"text/plain\", \"count\": 2\n}\ndata",
+		"data.html.meta":  "title = 'Data'\nfile-tags = [\"Special\"]",
+		"old.html":        "+++\nredirect = \"/about-us\"\n+++\nold",
+		"page.html":       `{{ (meta "about.html").title }} {{ (meta "data.html").title }} {{ (meta "data.html").count }} {{ (meta "page.html").n }}`,
+		"page.html.meta":  "n: 1",
+		"gz.html":         "---\ntitle: x\n---\ngz",
+		"gz.html.gz":      "compressed",
+		"orphan.txt.meta": "x: 1",
+		"nested.html":     "---\nimage:\n  path: /img/x.png\n  redirect: /x\nauthor:\n  name: Bob\n  links:\n  - a\n  - b\n---\nnested",
+	})
+
+	server := &Server{Options: Options{
+		TagPolicies: map[string]Policy{"Special": {Header: http.Header{"X-Special": {"yes"}}}},
+	}}
+	err := server.Initialize(fs, "resources", []Handler{
+		&TemplateHandler{
+			Resources: []string{"page.html"},
+			Template:  "page.html",
+			Path:      "/page",
+			Data: func(w http.ResponseWriter, r *http.Request) interface{} {
+				return true
+			},
+		},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		path, body string
+		status     int
+		header     string
+		value      string
+	}{
+		{"/about-us", "about", http.StatusOK, "Cache-Control", "no-store"},
+		{"/about.html", "", http.StatusNotFound, "", ""},
+		{"/data.html", "data", http.StatusOK, "Content-Type", "text/plain"},
+		{"/data.html", "data", http.StatusOK, "X-Special", "yes"},
+		{"/old.html", "", http.StatusMovedPermanently, "Location", "/about-us"},
+		{"/page", "About Data 2 1", http.StatusOK, "", ""},
+		{"/data.html.meta", "", http.StatusNotFound, "", ""},
+		{"/orphan.txt.meta", "", http.StatusNotFound, "", ""},
+		{"/nested.html", "nested", http.StatusOK, "", ""},
+	} {
+		rr := serveTest(t, server, "GET", c.path)
+		if rr.Code != c.status || (c.status == http.StatusOK && rr.Body.String() != c.body) || rr.Header().Get(c.header) != c.value {
+			t.Errorf("Wrong response for %v. Expected %v %q %v: %q, got %v %q %v", c.path, c.status, c.body, c.header, c.value, rr.Code, rr.Body.String(), rr.Header())
+		}
+	}
+
+	f, _ := server.Lookup("about.html")
+	if f.ETag != computeETag([]byte("about")) {
+		t.Errorf("ETag not updated after removing front matter.")
+	}
+	f, _ = server.Lookup("gz.html")
+	if f.Meta != nil || !strings.HasPrefix(string(f.Content), "---") {
+		t.Errorf("Front matter removed from a file with a precompressed version.")
+	}
+	f, _ = server.Lookup("nested.html")
+	expected := map[string]interface{}{
+		"image":  map[string]interface{}{"path": "/img/x.png", "redirect": "/x"},
+		"author": map[string]interface{}{"name": "Bob", "links": []interface{}{"a", "b"}},
+	}
+	if !reflect.DeepEqual(f.Meta, expected) {
+		t.Errorf("Wrong nested metadata. Expected %v, got %v", expected, f.Meta)
+	}
+
+	for in, expected := range map[string]string{
+		"---\ntitle: x\n  bad: 1\n---\n":   "Line 3: unexpected indentation.",
+		"---\na:\n    b: 1\n  c: 2\n---\n": "Line 4: unexpected indentation.",
+		"---\n\n# c\n- x\n---\n":           "Line 4: list item without a key.",
+		"+++\na = 1\nb\n+++\n":             "Line 3: expected \"key = value\".",
+		"---\na:\n  b: 1\n  c\n---\n":      "Line 4: expected \"key: value\".",
+	} {
+		_, _, err := parseFrontMatter([]byte(in))
+		if err == nil || err.Error() != expected {
+			t.Errorf("Wrong error for %q. Expected %q, got %v", in, expected, err)
+		}
+	}
+	if _, err := parseMeta([]byte("a: 1\n\tb: 2")); err == nil || err.Error() != "Line 2: unexpected indentation." {
+		t.Errorf("Wrong error for sidecar metadata: %v", err)
+	}
+
+	fs = getTestFS(t, map[string]string{
+		"bad.html": "---\ntitle: x\n",
+	})
+	err, _ = Initialize(fs, "resources", nil, errorHandler)
+	if err == nil {
+		t.Error("Unclosed front matter did not fail.")
+	}
+}
+
+func TestHijack(t *testing.T) {
+	fs := getTestFS(t, map[string]string{})
+
+	// The log line may be written after the client has its response, so hand it over on a channel.
+	logs := make(chanWriter, 1)
+	server := &Server{Options: Options{
+		Middleware: []Middleware{AccessLog(log.New(logs, "", 0), JSONLogFormat)},
+	}}
+	err := server.Initialize(fs, "resources", []Handler{
+		&SimpleHandler{
+			Path: "/hijack",
+			Logic: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hj, ok := w.(http.Hijacker)
+				if !ok {
+					w.WriteHeader(http.StatusTeapot)
+					return
+				}
+				conn, rw, err := hj.Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close()
+				rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+				rw.Flush()
+			}),
+		},
+		&SimpleHandler{
+			Path: "/readfrom",
+			Logic: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				rf, ok := w.(io.ReaderFrom)
+				if !ok {
+					w.WriteHeader(http.StatusTeapot)
+					return
+				}
+				rf.ReadFrom(strings.NewReader("copied"))
+			}),
+		},
+	}, errorHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	for _, c := range []struct {
+		path, body string
+		status     int
+		bytes      int64
+	}{
+		{"/hijack", "hijacked", http.StatusSwitchingProtocols, 0},
+		{"/readfrom", "copied", http.StatusOK, 6},
+	} {
+		resp, err := http.Get(ts.URL + c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != c.body {
+			t.Errorf("Wrong response for %v. Expected %q, got %v %q", c.path, c.body, resp.StatusCode, body)
+		}
+
+		line := <-logs
+		entry := AccessLogEntry{}
+		err = json.Unmarshal([]byte(line), &entry)
+		if err != nil || entry.Status != c.status || entry.Bytes != c.bytes {
+			t.Errorf("Wrong log entry for %v: %v %v", c.path, err, line)
+		}
+	}
+}
+
+// Helpers
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type chanWriter chan string
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+func errorHandler(w http.ResponseWriter, r *http.Request, status int) {
+	w.WriteHeader(status)
+}
 
-	req, err := http.NewRequest("GET", "/static.css", nil)
+// serveTest runs a request through the server's handlers and returns the recorded response.
+func serveTest(t *testing.T, server *Server, method, path string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	return serveRequest(t, server, req)
+}
 
+// serveRequest is serveTest for a request that has already been built.
+func serveRequest(t *testing.T, server *Server, req *http.Request) *httptest.ResponseRecorder {
 	rr := httptest.NewRecorder()
 	handler, pattern := server.Handlers.Handler(req)
 	if pattern == "" {
@@ -106,38 +1897,87 @@ func TestStatic(t *testing.T) {
 		t.Fatal("No handler found.")
 	}
 	handler.ServeHTTP(rr, req)
-	if rr.Code != http.StatusOK {
-		t.Errorf("Wrong response. Expected %v, got %v", http.StatusOK, rr.Code)
+	return rr
+}
+
+// getTestSources returns the given files as every kind of DataSource, with the files under "resources".
+func getTestSources(t *testing.T, files map[string]string) map[string]DataSource {
+	mfs := fstest.MapFS{}
+	for name, content := range files {
+		mfs["resources/"+name] = &fstest.MapFile{Data: []byte(content)}
 	}
-	if rr.Body.String() != "This is a static file" {
-		t.Errorf("Wrong body. Expected %q, got %q", "This is a static file", rr.Body.String())
+	return map[string]DataSource{
+		"axis2": getTestFS(t, files),
+		"io/fs": FS(mfs),
 	}
 }
 
-// Helpers
-////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// getTestFS builds a zip from the given files and mounts it at "resources".
+func getTestFS(t *testing.T, files map[string]string) *axis2.FileSystem {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func errorHandler(w http.ResponseWriter, r *http.Request, status int) {
-	w.WriteHeader(status)
+	fs := new(axis2.FileSystem)
+	dir, err := axiszip.NewRawDir(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Mount("resources", dir, false)
+	return fs
 }
 
-var test_server *Server
+var test_servers map[string]*Server
+
+// forEachTestServer runs f with a test server for every kind of DataSource.
+func forEachTestServer(t *testing.T, f func(t *testing.T, server *Server)) {
+	for name, server := range getTestServers(t) {
+		t.Run(name, func(t *testing.T) {
+			f(t, server)
+		})
+	}
+}
 
-func getTestServer(t *testing.T) *Server {
-	if test_server != nil {
-		return test_server
+// getTestServers returns the standard test server loaded from each kind of DataSource. Both use the same test data.
+func getTestServers(t *testing.T) map[string]*Server {
+	if test_servers != nil {
+		return test_servers
 	}
 
 	// Load the test data into AXIS
 	fs := new(axis2.FileSystem)
-	dir, err := zip.NewRawDir(TestData)
+	dir, err := axiszip.NewRawDir(TestData)
 	if err != nil {
 		t.Fatal(err)
 	}
 	fs.Mount("resources", dir, false)
 
-	// Set up a simple test server.
-	err, test_server = Initialize(fs, "resources", []Handler{
+	// And as an io/fs.FS
+	zr, err := zip.NewReader(bytes.NewReader(TestData), int64(len(TestData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test_servers = map[string]*Server{
+		"axis2": getTestServer(t, fs, "resources"),
+		"io/fs": getTestServer(t, FS(zr), ""),
+	}
+	return test_servers
+}
+
+// getTestServer sets up a simple test server.
+func getTestServer(t *testing.T, fs DataSource, path string) *Server {
+	err, server := Initialize(fs, path, []Handler{
 		&TemplateHandler{
 			Resources: []string{"template.html"},
 			Template:  "template.html",
@@ -157,8 +1997,7 @@ func getTestServer(t *testing.T) *Server {
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	return test_server
+	return server
 }
 
 var TestData []byte
@@ -0,0 +1,88 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import iofs "io/fs"
+import filepath "path"
+
+import "github.com/milochristiansen/axis2"
+
+// DataSource is anything Initialize can load the data tree from. Paths use forward slashes and never start with one.
+//
+// *axis2.FileSystem is a DataSource as is, use FS to load from an io/fs.FS (such as an embed.FS).
+type DataSource interface {
+	// ListFiles returns the names of the files in the given directory.
+	ListFiles(path string) []string
+
+	// ListDirs returns the names of the directories in the given directory.
+	ListDirs(path string) []string
+
+	// ReadAll returns the contents of the given file.
+	ReadAll(path string) ([]byte, error)
+}
+
+var _ DataSource = (*axis2.FileSystem)(nil)
+
+type fsSource struct {
+	fsys iofs.FS
+}
+
+// FS wraps an io/fs.FS so that it may be used as a DataSource.
+func FS(fsys iofs.FS) DataSource {
+	return fsSource{fsys}
+}
+
+func (src fsSource) list(path string, dirs bool) []string {
+	entries, err := iofs.ReadDir(src.fsys, fsPath(path))
+	if err != nil {
+		return nil
+	}
+
+	rtn := []string{}
+	for _, e := range entries {
+		if e.IsDir() == dirs {
+			rtn = append(rtn, e.Name())
+		}
+	}
+	return rtn
+}
+
+func (src fsSource) ListFiles(path string) []string {
+	return src.list(path, false)
+}
+
+func (src fsSource) ListDirs(path string) []string {
+	return src.list(path, true)
+}
+
+func (src fsSource) ReadAll(path string) ([]byte, error) {
+	return iofs.ReadFile(src.fsys, fsPath(path))
+}
+
+// fsPath converts a data tree path to the form io/fs expects.
+func fsPath(path string) string {
+	if path == "" {
+		return "."
+	}
+	return filepath.Clean(path)
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "net/http"
+import "strings"
+import filepath "path"
+
+// staticPaths returns the path a static file is found at in the data directory, and the path it is linked as. Which
+// one is served and which one redirects depends on the Options.
+//
+// Fingerprinted files (see Options.FingerprintTags) and files with a path in their metadata are not affected by
+// IndexFiles or CleanURLs.
+func (s *Server) staticPaths(f *File) (p, canonical string) {
+	p = "/" + s.relativePath(f)
+	explicit := metaString(f, "path")
+	if explicit != "" {
+		p = "/" + strings.TrimPrefix(explicit, "/")
+	}
+	if s.fingerprinted(f) {
+		return p, fingerprintPath(p, f)
+	}
+	if explicit != "" {
+		return p, p
+	}
+
+	canonical = p
+	for _, name := range s.IndexFiles {
+		if f.Name == name {
+			canonical = filepath.Dir(p)
+			if canonical != "/" {
+				canonical += "/"
+			}
+			break
+		}
+	}
+	if canonical == p && s.CleanURLs && f.Tags["HTML"] && getExt(f.Name) != "" {
+		canonical = stripExt(p)
+	}
+	return p, canonical
+}
+
+// mountStatic creates the handlers for a static file. Depending on the Options a file may be served from more than
+// one path, or its real path may redirect to another.
+func (s *Server) mountStatic(f *File) error {
+	p, canonical := s.staticPaths(f)
+	if target := metaString(f, "redirect"); target != "" {
+		s.urls[f.FullPath()] = target
+		if canonical != p {
+			err := s.mountRedirect(canonical, target, f, http.StatusMovedPermanently)
+			if err != nil {
+				return err
+			}
+		}
+		return s.mountRedirect(p, target, f, http.StatusMovedPermanently)
+	}
+
+	policy := s.policy(f)
+	if s.fingerprinted(f) {
+		return s.mountFingerprinted(p, f, policy)
+	}
+
+	s.urls[f.FullPath()] = canonical
+
+	if canonical != p {
+		if canonical != "/" && strings.HasSuffix(canonical, "/") {
+			// Index files, redirect requests for the directory without a slash.
+			err := s.mountRedirect(strings.TrimSuffix(canonical, "/"), canonical, f, http.StatusMovedPermanently)
+			if err != nil {
+				return err
+			}
+		}
+		err := s.mountFile(canonical, f, policy)
+		if err != nil {
+			return err
+		}
+		if s.StrictURLs {
+			return s.mountRedirect(p, canonical, f, http.StatusMovedPermanently)
+		}
+	}
+	return s.mountFile(p, f, policy)
+}
+
+// mountFile serves f at p with the headers from policy.
+func (s *Server) mountFile(p string, f *File, policy *Policy) error {
+	route := &Route{Pattern: p, Handler: "Static", File: f}
+	return s.mountStaticHandler(p, staticMethods, s.wrap(route, s.tagMiddleware(f), staticPageHandler(f, s, policy)))
+}
+
+// mountRedirect redirects p to target, which is where f is really served.
+func (s *Server) mountRedirect(p, target string, f *File, status int) error {
+	route := &Route{Pattern: p, Handler: "Redirect", File: f}
+	return s.mountStaticHandler(p, nil, s.wrap(route, nil, redirectHandler(target, status)))
+}
+
+func (s *Server) mountStaticHandler(p string, methods []string, h http.HandlerFunc) error {
+	s.log.i.Println("Building handler for ", p)
+	err := s.reservePath(p, methods)
+	if err != nil {
+		return err
+	}
+
+	s.handle(p, false, methods, h)
+	return nil
+}
+
+// redirectHandler redirects requests to target, keeping the query string.
+func redirectHandler(target string, status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		to := target
+		if r.URL.RawQuery != "" {
+			to += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, to, status)
+	}
+}
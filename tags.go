@@ -25,14 +25,19 @@ package httphelper
 // First/Last part tags for classifying files during load.
 // Hardcoded Tags: Resource
 var TagsFirst = map[string][]string{
-	".go":     {"Go"},
-	".static": {"Static"},
+	".go":      {"Go"},
+	".static":  {"Static"},
+	".layout":  {"Layout"},
+	".partial": {"Partial"},
 }
 var TagsLast = map[string][]string{
-	".htm":  {"HTML"},
-	".html": {"HTML"},
-	".css":  {"StyleSheet"},
-	".js":   {"JavaScript"},
+	".htm":    {"HTML"},
+	".html":   {"HTML"},
+	".css":    {"StyleSheet"},
+	".js":     {"JavaScript"},
+	".bundle": {"Bundle"},
+	".md":     {"Markdown"},
+	".meta":   {"Meta"},
 }
 
 // GetFileTags finds the file tags for a file with the given name.
@@ -0,0 +1,106 @@
+/*
+Copyright 2020 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package httphelper
+
+import "html/template"
+import "errors"
+import "sort"
+import "mime"
+import filepath "path"
+
+// Files tagged Layout or Partial are parsed into a template set shared by every TemplateHandler. They are named after
+// the file with both parts of the extension removed, so "base.layout.html" may be used as "base", and
+// "nav.partial.html" as {{ template "nav" . }}. Both are resources, and never served directly.
+//
+// A layout is a normal template that uses {{ block "name" . }} for the parts pages may replace. A TemplateHandler that
+// names a layout renders it, with the page's {{ define "name" }} actions filling in the blocks. Since all the files
+// share one set, blocks with the same name in different layouts must have the same default content.
+
+// loadTemplates builds the shared template set from all the layouts and partials.
+func loadTemplates(s *Server) error {
+	s.templates = template.New("").Funcs(templateFuncs(s))
+
+	paths := []string{}
+	for p, f := range s.Files {
+		if f.Tags["Layout"] || f.Tags["Partial"] {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	defined := map[string]string{}
+	for _, p := range paths {
+		f := s.Files[p]
+		f.Tags["Resource"] = true
+
+		name := templateName(f.Name)
+		if other, ok := defined[name]; ok {
+			s.log.e.Println("Error: Both ", other, " and ", p, " define the template ", name)
+			return errors.New("Both " + other + " and " + p + " define the template " + name)
+		}
+		defined[name] = p
+
+		_, err := s.templates.New(name).Parse(string(f.Content))
+		if err != nil {
+			s.log.e.Println("Error: ", err, " while parsing ", p)
+			return err
+		}
+	}
+	return nil
+}
+
+// templateName strips the tag and type extensions from the name of a layout or partial.
+func templateName(name string) string {
+	first, last := getExtParts(name)
+	return name[:len(name)-len(first)-len(last)]
+}
+
+// loadPage parses a template file into a copy of the shared set. If layout is set the layout is returned instead of the
+// page (which will have filled in the layout's blocks). Also returns the Content-Type for the result.
+func (s *Server) loadPage(path, layout string) (*template.Template, string, error) {
+	f, err := s.Lookup(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	set, err := s.templates.Clone()
+	if err != nil {
+		return nil, "", err
+	}
+	page, err := set.New(stripExt(filepath.Base(path))).Parse(string(f.Content))
+	if err != nil {
+		return nil, "", err
+	}
+	if layout != "" {
+		page = set.Lookup(layout)
+		if page == nil {
+			return nil, "", errors.New("Layout " + layout + " does not exist.")
+		}
+	}
+
+	typ := mime.TypeByExtension(getExt(f.Name))
+	if typ == "" {
+		typ = "text/html; charset=utf-8"
+	}
+	return page, typ, nil
+}